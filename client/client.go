@@ -2,6 +2,7 @@ package glock
 
 import (
 	"bufio"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -26,12 +27,34 @@ type internalError struct {
 	error
 }
 
+// movedError is a MOVED response: the server knows the ring, and endpoint owns the key.
+type movedError struct {
+	error
+	endpoint string
+}
+
 type CapacityError struct {
 	error
 }
 
+// ErrNotExtended is returned by Extend when the lock is no longer held with the given id.
+var ErrNotExtended = errors.New("NOT_EXTENDED")
+
+// WaitTimeoutError is returned when a lock couldn't be acquired within the requested wait.
+type WaitTimeoutError struct {
+	error
+}
+
+// UnavailableError is returned for a key whose server failed or just came back,
+// while the key may still be locked elsewhere, see ClientOptions.RehomeDelay.
+type UnavailableError struct {
+	error
+}
+
 type Client struct {
 	endpoints       []string
+	endpointsLock   sync.RWMutex
+	ringLock        sync.Mutex // held while changing the endpoints, from the servers' topology or discovery
 	consistent      *consistent.Consistent
 	poolsLock       sync.RWMutex
 	connectionPools map[string]chan *connection
@@ -42,6 +65,10 @@ type Client struct {
 	// some refactoring required to embed this as a part of connectionPools
 	connectionCount map[string]*int32
 	countLock       sync.RWMutex
+
+	rehomeDelay    time.Duration
+	quarantineLock sync.Mutex
+	quarantined    map[string]time.Time // until when the keys of an endpoint that failed or came back are unavailable
 }
 
 type connection struct {
@@ -49,8 +76,20 @@ type connection struct {
 	conn     net.Conn
 	reader   *bufio.Reader
 	client   *Client
+	deadline time.Time // applied to every read and write; zero means none
+	broken   bool      // a request was cut off, so a late response may still arrive
 }
 
+// how long to wait for the server to answer a CANCEL before giving up on the connection
+const cancelTimeout = 5 * time.Second
+
+// how long dialing a failover group keeps trying its servers, which has to be
+// longer than their failover_timeout, and how long it waits between rounds
+const (
+	failoverWait  = 10 * time.Second
+	failoverRetry = 100 * time.Millisecond
+)
+
 // func (c *Client) ClosePool() error {
 // 	size := len(c.connectionPool)
 // 	for x := 0; x < size; x++ {
@@ -71,21 +110,76 @@ func (c *Client) Size() int {
 	return size
 }
 
+// NewClient returns a client that spreads keys over the glock servers at
+// endpoints. An endpoint can also be a failover group, a primary and its
+// replicas separated by commas, such as "10.0.0.1:45625,10.0.0.2:45625". The
+// keys of a group stay with it when its primary goes down, and are locked at
+// whichever of its servers took over. The servers of a cluster are given as a
+// group as well, and the keys are locked at its leader. If the servers know the
+// ring they share, endpoints are only used to ask one of them for it, and the
+// client spreads keys over the ring instead.
 func NewClient(endpoints []string, size int, username, password string) (*Client, error) {
+	return NewClientWithOptions(endpoints, size, username, password, ClientOptions{})
+}
+
+// ClientOptions holds the optional settings for NewClientWithOptions.
+type ClientOptions struct {
+	// RehomeDelay keeps keys from moving to another server while they may still
+	// be locked where they were. When a server fails, its keys are unavailable
+	// for RehomeDelay before they're locked at another server, and when it comes
+	// back, for RehomeDelay before they're locked at it again. Locking them in
+	// the meantime fails with an *UnavailableError. It should be at least the
+	// longest duration any client locks keys for. By default, keys move right away.
+	RehomeDelay time.Duration
+
+	// Discover names the servers to look up with Resolver, in place of the
+	// endpoints: an SRV name such as "_glock._tcp.example.com", or a host:port
+	// whose host has A or AAAA records. The name is looked up again every
+	// DiscoveryInterval, a minute by default, and servers are added and removed
+	// as the records change.
+	Discover          string
+	Resolver          Resolver // DNSResolver by default
+	DiscoveryInterval time.Duration
+}
+
+// NewClientWithOptions is like NewClient, with optional settings.
+func NewClientWithOptions(endpoints []string, size int, username, password string, opts ClientOptions) (*Client, error) {
+	if opts.Discover != "" {
+		if opts.Resolver == nil {
+			opts.Resolver = &DNSResolver{}
+		}
+		if opts.DiscoveryInterval == 0 {
+			opts.DiscoveryInterval = time.Minute
+		}
+		var err error
+		if endpoints, err = resolve(opts.Resolver, opts.Discover); err != nil {
+			return nil, err
+		}
+	}
+
 	client := &Client{consistent: consistent.New(), connectionPools: make(map[string]chan *connection), endpoints: endpoints,
-		poolSize: size, connectionCount: make(map[string]*int32), username: username, password: password}
+		poolSize: size, connectionCount: make(map[string]*int32), username: username, password: password,
+		rehomeDelay: opts.RehomeDelay, quarantined: make(map[string]time.Time)}
+	if topology := client.fetchTopology(endpoints); topology != nil {
+		client.endpoints = topology
+	}
 	client.initPool()
 	client.CheckServerStatus()
+	if opts.Discover != "" {
+		go client.discover(opts.Resolver, opts.Discover, opts.DiscoveryInterval)
+	}
 
 	log15.Debug("glock client init", "pool_size", size)
 	return client, nil
 }
 
 func (c *Client) initPool() {
-	c.addEndpoints(c.endpoints)
+	c.addEndpoints(c.endpoints, false)
 }
 
-func (c *Client) addEndpoints(endpoints []string) {
+// addEndpoints connects to endpoints and adds them to the hash ring. Endpoints
+// that join a ring that is already in use are quarantined first.
+func (c *Client) addEndpoints(endpoints []string, joining bool) {
 	for _, endpoint := range endpoints {
 		log15.Info("glock client adding endpoint", "endpoint", endpoint)
 		conn, err := dial(endpoint, c.username, c.password)
@@ -101,6 +195,10 @@ func (c *Client) addEndpoints(endpoints []string) {
 			c.connectionCount[endpoint] = new(int32)
 			c.countLock.Unlock()
 
+			if joining {
+				// its keys may still be locked at the servers they moved to
+				c.quarantine(endpoint)
+			}
 			c.consistent.Add(endpoint)
 			log15.Info("glock client added endpoint", "endpoint", endpoint)
 		} else {
@@ -110,13 +208,44 @@ func (c *Client) addEndpoints(endpoints []string) {
 }
 
 func (c *Client) getConnection(key string) (*connection, error) {
-	server, err := c.consistent.Get(key)
+	server, err := c.serverFor(key)
 	if err != nil {
-		log15.Error("glock client consistent hashing error", "key", key, "err", err)
 		return nil, err
 	}
 	log15.Debug("glock client in getConn", "server", server, "key", key)
 
+	return c.getServerConnection(server)
+}
+
+// serverFor returns the endpoint that owns key, unless it's quarantined.
+func (c *Client) serverFor(key string) (string, error) {
+	server, err := c.consistent.Get(key)
+	if err != nil {
+		log15.Error("glock client consistent hashing error", "key", key, "err", err)
+		return "", err
+	}
+	c.quarantineLock.Lock()
+	until := c.quarantined[server]
+	c.quarantineLock.Unlock()
+	if time.Now().Before(until) {
+		return "", &UnavailableError{fmt.Errorf("keys of %s unavailable until %s", server, until.Format(time.RFC3339))}
+	}
+	return server, nil
+}
+
+// quarantine makes the keys of endpoint unavailable for the rehome delay, if there is one.
+func (c *Client) quarantine(endpoint string) {
+	if c.rehomeDelay == 0 {
+		return
+	}
+	log15.Info("glock client quarantining endpoint", "endpoint", endpoint, "delay", c.rehomeDelay)
+	c.quarantineLock.Lock()
+	c.quarantined[endpoint] = time.Now().Add(c.rehomeDelay)
+	c.quarantineLock.Unlock()
+}
+
+// getServerConnection returns a connection to a particular server, whichever keys it owns.
+func (c *Client) getServerConnection(server string) (*connection, error) {
 	c.poolsLock.RLock()
 	connectionPool, ok := c.connectionPools[server]
 	c.poolsLock.RUnlock()
@@ -144,6 +273,8 @@ func (c *Client) getConnection(key string) (*connection, error) {
 }
 
 func (c *Client) releaseConnection(connection *connection) {
+	connection.deadline = time.Time{}
+
 	c.poolsLock.RLock()
 	connectionPool, ok := c.connectionPools[connection.endpoint]
 	c.poolsLock.RUnlock()
@@ -152,10 +283,14 @@ func (c *Client) releaseConnection(connection *connection) {
 		return
 	}
 
-	select {
-	case connectionPool <- connection:
-	default:
+	if connection.broken {
 		connection.Close()
+	} else {
+		select {
+		case connectionPool <- connection:
+		default:
+			connection.Close()
+		}
 	}
 
 	c.countLock.Lock()
@@ -163,54 +298,319 @@ func (c *Client) releaseConnection(connection *connection) {
 	c.countLock.Unlock()
 }
 
+// Lock waits for the lock on key and holds it for duration, or until it's unlocked.
+// The returned id is a random token that only unlocks the lock for the same
+// user. For a fencing token, use Acquire and Lease.Fence.
 func (c *Client) Lock(key string, duration time.Duration) (id int64, err error) {
+	id, _, err = c.lock(context.Background(), key, "LOCK "+key, duration, nil)
+	return id, err
+}
+
+// LockWait is like Lock, but gives up with a *WaitTimeoutError if the lock
+// can't be acquired within wait. Once acquired, the lock is held for duration.
+func (c *Client) LockWait(key string, duration, wait time.Duration) (id int64, err error) {
+	if wait < 0 {
+		wait = 0
+	}
+	id, _, err = c.lock(context.Background(), key, "LOCK "+key, duration, nil, fmt.Sprintf("wait=%d", int(wait/time.Millisecond)))
+	return id, err
+}
+
+// LockContext is like Lock, but gives up waiting for the lock with ctx.Err() once
+// ctx is done. The server is told to drop the queued request, so it won't later
+// acquire a lock nobody is waiting for. ctx's deadline also bounds the socket I/O.
+func (c *Client) LockContext(ctx context.Context, key string, duration time.Duration) (id int64, err error) {
+	id, _, err = c.lock(ctx, key, "LOCK "+key, duration, nil)
+	return id, err
+}
+
+// LockQueued is like LockContext, but while it waits queued is called with its
+// position in line for the lock, starting at 1, whenever that changes. Locks are
+// handed out in the order they were asked for.
+func (c *Client) LockQueued(ctx context.Context, key string, duration time.Duration, queued func(position int)) (id int64, err error) {
+	return c.LockWithOptions(ctx, key, duration, LockOptions{Queued: queued})
+}
+
+// LockOptions holds the optional settings for LockWithOptions.
+type LockOptions struct {
+	// Priority lets the request jump ahead of lower priority requests waiting
+	// for the same key. Requests with the same priority are served in the order
+	// they were made. To keep low priorities from starving, the server counts
+	// every so often spent waiting (a second by default) as one level of priority.
+	Priority int
+
+	// Queued, if set, is called with the request's position in line, starting
+	// at 1, whenever that changes.
+	Queued func(position int)
+
+	// Owner makes the lock reentrant: while Owner holds the lock, locking it
+	// again with the same Owner returns the same id right away, taking another
+	// hold that needs an Unlock of its own. The lock's duration starts over with
+	// every hold. Owner can't contain spaces.
+	Owner string
+}
+
+// LockWithOptions is like LockContext, with optional settings.
+func (c *Client) LockWithOptions(ctx context.Context, key string, duration time.Duration, opts LockOptions) (id int64, err error) {
+	id, _, err = c.lockWithOptions(ctx, key, duration, opts)
+	return id, err
+}
+
+func (c *Client) lockWithOptions(ctx context.Context, key string, duration time.Duration, opts LockOptions) (id, fence int64, err error) {
+	var options []string
+	if opts.Priority != 0 {
+		options = append(options, fmt.Sprintf("priority=%d", opts.Priority))
+	}
+	if opts.Queued != nil {
+		options = append(options, "queued=1")
+	}
+	if opts.Owner != "" {
+		options = append(options, "owner="+opts.Owner)
+	}
+	return c.lock(ctx, key, "LOCK "+key, duration, opts.Queued, options...)
+}
+
+// AcquireSemaphore takes permits out of the max permits of the semaphore on key,
+// waiting until enough of them are free or ctx is done. Each acquisition is held
+// for duration, or until it's released with ReleaseSemaphore, and is returned as
+// an id of its own. The first acquisition decides the semaphore's max, and one
+// that asks for another max while the semaphore is in use fails.
+func (c *Client) AcquireSemaphore(ctx context.Context, key string, permits, max int, duration time.Duration) (id int64, err error) {
+	id, _, err = c.lock(ctx, key, fmt.Sprintf("ACQUIRE %s %d %d", key, permits, max), duration, nil)
+	return id, err
+}
+
+// lock sends command, a LOCK or an ACQUIRE up to the timeout, with the given name=value options.
+func (c *Client) lock(ctx context.Context, key, command string, duration time.Duration, queued func(position int), options ...string) (id, fence int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return id, fence, err
+	}
+
 	// its important that we get the server before we do getConnection (instead of inside getConnection) because if that error drops we need to put the connection back to the original mapping.
 
 	connection, err := c.getConnection(key)
 	if err != nil {
-		return id, err
+		return id, fence, err
 	}
 	defer c.releaseConnection(connection)
 
-	id, err = connection.lock(key, duration)
+	id, fence, err = connection.lock(ctx, key, command, duration, queued, options)
 	if err != nil {
-		if err, ok := err.(*connectionError); ok {
+		if c.followMoved(err, key) {
+			return c.lock(ctx, key, command, duration, queued, options...)
+		}
+		if err, ok := err.(*connectionError); ok && ctx.Err() == nil {
 			log15.Error("glock client connection error, couldn't get lock. Removing endpoint from hash table", "server", connection.endpoint, "err", err)
-			c.removeEndpoint(connection.endpoint)
+			connection.broken = true
+			c.endpointFailed(connection.endpoint)
 			// todo for evan/treeder, if it is a connection error remove the failed server and then lock again recursively
-			return c.Lock(key, duration)
+			return c.lock(ctx, key, command, duration, queued, options...)
 		}
 		log15.Error("glock client error trying to get lock", "endpoint", connection.endpoint, "err", err)
-		return id, err
+		return id, fence, err
 	}
-	return id, nil
+	return id, fence, nil
 }
 
-func (c *connection) lock(key string, duration time.Duration) (id int64, err error) {
-	err = c.fprintf("LOCK %s %d\r\n", key, int(duration/time.Millisecond))
+func (c *connection) lock(ctx context.Context, key, command string, duration time.Duration, queued func(position int), options []string) (id, fence int64, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.deadline = deadline
+	}
+	err = c.fprintf("%s %d%s\r\n", command, int(duration/time.Millisecond), formatOptions(options))
 	if err != nil {
 		log15.Error("glock client lock error", "err", err)
-		return id, err
+		return id, fence, err
+	}
+
+	if ctx.Done() == nil {
+		splits, err := readLockResponse(c.readResponse, queued)
+		if err != nil {
+			log15.Error("glock client lock readResponse", "err", err)
+			return id, fence, err
+		}
+		return parseLocked(splits)
+	}
+
+	// The wait for the lock is bounded by ctx through a CANCEL rather than by
+	// the socket deadline, so that the connection stays usable afterwards.
+	c.conn.SetReadDeadline(time.Time{})
+	type response struct {
+		splits []string
+		err    error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		splits, err := readLockResponse(func() ([]string, error) { return ReadSplits(c.reader) }, queued)
+		responses <- response{splits, err}
+	}()
+
+	select {
+	case r := <-responses:
+		if r.err != nil {
+			log15.Error("glock client lock readResponse", "err", r.err)
+			return id, fence, r.err
+		}
+		return parseLocked(r.splits)
+	case <-ctx.Done():
+	}
+
+	c.deadline = time.Now().Add(cancelTimeout)
+	c.conn.SetDeadline(c.deadline)
+	_, err = fmt.Fprintf(c.conn, "CANCEL\r\n")
+	if err != nil {
+		c.broken = true
+		return id, fence, ctx.Err()
+	}
+
+	r := <-responses
+	if r.err != nil {
+		if _, ok := r.err.(*connectionError); ok {
+			c.broken = true
+			return id, fence, ctx.Err()
+		}
+	} else if r.splits[0] == "CANCELED" {
+		return id, fence, ctx.Err()
+	}
+
+	// The LOCK finished before the server saw the CANCEL, which then gets a response of its own.
+	splits, err := ReadSplits(c.reader)
+	if err != nil || splits[0] != "NOT_CANCELED" {
+		c.broken = true
+		return id, fence, ctx.Err()
+	}
+	if r.err == nil {
+		if lockedID, _, err := parseLocked(r.splits); err == nil {
+			// nobody is waiting for this lock anymore
+			if err := c.unlock("UNLOCK", key, lockedID); err != nil {
+				log15.Error("glock client error releasing canceled lock", "key", key, "id", lockedID, "err", err)
+			}
+		}
+	}
+	return id, fence, ctx.Err()
+}
+
+// readLockResponse reads the response to a LOCK, passing the positions from any QUEUED lines before it to queued.
+func readLockResponse(read func() ([]string, error), queued func(position int)) ([]string, error) {
+	for {
+		splits, err := read()
+		if err != nil || splits[0] != "QUEUED" {
+			return splits, err
+		}
+		if queued == nil || len(splits) < 2 {
+			continue
+		}
+		if position, err := strconv.Atoi(splits[1]); err == nil {
+			queued(position)
+		}
+	}
+}
+
+// TryLock is like Lock, but returns immediately with ok set to false if the lock is already held.
+func (c *Client) TryLock(key string, duration time.Duration) (id int64, ok bool, err error) {
+	connection, err := c.getConnection(key)
+	if err != nil {
+		return id, false, err
+	}
+	defer c.releaseConnection(connection)
+
+	id, ok, err = connection.tryLock(key, duration)
+	if err != nil {
+		if c.followMoved(err, key) {
+			return c.TryLock(key, duration)
+		}
+		if err, isConnErr := err.(*connectionError); isConnErr {
+			log15.Error("glock client connection error, couldn't try lock. Removing endpoint from hash table", "server", connection.endpoint, "err", err)
+			connection.broken = true
+			c.endpointFailed(connection.endpoint)
+			return c.TryLock(key, duration)
+		}
+		log15.Error("glock client error trying to try lock", "endpoint", connection.endpoint, "err", err)
+		return id, false, err
+	}
+	return id, ok, nil
+}
+
+func (c *connection) tryLock(key string, duration time.Duration) (id int64, ok bool, err error) {
+	err = c.fprintf("TRYLOCK %s %d\r\n", key, int(duration/time.Millisecond))
+	if err != nil {
+		log15.Error("glock client trylock error", "err", err)
+		return id, false, err
 	}
 
 	splits, err := c.readResponse()
 	if err != nil {
-		log15.Error("glock client lock readResponse", "err", err)
-		return id, err
+		log15.Error("glock client trylock readResponse", "err", err)
+		return id, false, err
+	}
+
+	if splits[0] == "NOT_LOCKED" {
+		return id, false, nil
+	}
+	id, _, err = parseLocked(splits)
+	if err != nil {
+		return id, false, err
+	}
+	return id, true, nil
+}
+
+// formatOptions turns name=value options into the tail of a command.
+func formatOptions(options []string) string {
+	if len(options) == 0 {
+		return ""
+	}
+	return " " + strings.Join(options, " ")
+}
+
+// parseLocked returns the lock id and fencing token from a "LOCKED <id> <fence>"
+// or "ACQUIRED <id> <fence>" response.
+func parseLocked(splits []string) (id, fence int64, err error) {
+	if (splits[0] != "LOCKED" && splits[0] != "ACQUIRED") || len(splits) < 3 {
+		return id, fence, &internalError{errors.New("Unknown reponse format")}
 	}
 
 	id, err = strconv.ParseInt(splits[1], 10, 64)
 	if err != nil {
-		return id, &internalError{err}
+		return id, fence, &internalError{err}
+	}
+	fence, err = strconv.ParseInt(splits[2], 10, 64)
+	if err != nil {
+		return id, fence, &internalError{err}
 	}
 
-	return id, nil
+	return id, fence, nil
+}
+
+// endpointFailed handles a connection error on endpoint. A server is taken out of
+// the hash ring, but a failover group keeps its keys: its pooled connections are
+// dropped, so that the next ones are dialed to whichever server took over.
+func (c *Client) endpointFailed(endpoint string) {
+	if !strings.Contains(endpoint, ",") {
+		c.removeEndpoint(endpoint)
+		return
+	}
+	log15.Error("glock client dropping connections to failover group", "endpoint", endpoint)
+	c.poolsLock.RLock()
+	pool, ok := c.connectionPools[endpoint]
+	c.poolsLock.RUnlock()
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case connection := <-pool:
+			connection.Close()
+		default:
+			return
+		}
+	}
 }
 
 func (c *Client) removeEndpoint(endpoint string) {
 	log15.Error("glock client removing endpoint", "endpoint", endpoint)
-	// remove from hash first
-	c.consistent.Remove(endpoint)
+	if c.rehomeDelay == 0 {
+		// remove from hash first
+		c.consistent.Remove(endpoint)
+	}
 	// then we should get rid of all the connections
 
 	c.poolsLock.RLock()
@@ -231,9 +631,30 @@ func (c *Client) removeEndpoint(endpoint string) {
 		delete(c.connectionCount, endpoint)
 	}
 	c.countLock.Unlock()
+
+	if c.rehomeDelay > 0 {
+		// its keys stay with it, unavailable, until the locks on them there timed out
+		c.quarantine(endpoint)
+		time.AfterFunc(c.rehomeDelay, func() {
+			c.poolsLock.RLock()
+			_, rejoined := c.connectionPools[endpoint]
+			c.poolsLock.RUnlock()
+			if !rejoined {
+				c.consistent.Remove(endpoint)
+			}
+		})
+	}
 }
 
 func (c *Client) Unlock(key string, id int64) (err error) {
+	return c.UnlockContext(context.Background(), key, id)
+}
+
+// UnlockContext is like Unlock, but ctx's deadline bounds the socket I/O.
+func (c *Client) UnlockContext(ctx context.Context, key string, id int64) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	connection, err := c.getConnection(key)
 	if err != nil {
@@ -241,13 +662,53 @@ func (c *Client) Unlock(key string, id int64) (err error) {
 	}
 	defer c.releaseConnection(connection)
 
-	err = connection.fprintf("UNLOCK %s %d\r\n", key, id)
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.deadline = deadline
+	}
+	err = connection.unlock("UNLOCK", key, id)
+	if c.followMoved(err, key) {
+		return c.UnlockContext(ctx, key, id)
+	}
+	return err
+}
+
+// RLock takes a read lock on key, waiting for as long as it takes. Any number of
+// read locks can be held at once, each with its own id and duration, but not
+// together with a Lock. Read locks requested while a Lock is waiting wait behind it.
+func (c *Client) RLock(key string, duration time.Duration) (id int64, err error) {
+	return c.RLockContext(context.Background(), key, duration)
+}
+
+// RLockContext is like RLock, but gives up waiting with ctx.Err() once ctx is done.
+func (c *Client) RLockContext(ctx context.Context, key string, duration time.Duration) (id int64, err error) {
+	id, _, err = c.lock(ctx, key, "RLOCK "+key, duration, nil)
+	return id, err
+}
+
+// RUnlock releases the read lock on key held with id.
+func (c *Client) RUnlock(key string, id int64) (err error) {
+	connection, err := c.getConnection(key)
+	if err != nil {
+		return err
+	}
+	defer c.releaseConnection(connection)
+
+	err = connection.unlock("RUNLOCK", key, id)
+	if c.followMoved(err, key) {
+		return c.RUnlock(key, id)
+	}
+	return err
+}
+
+// unlock sends an UNLOCK or RUNLOCK.
+func (c *connection) unlock(command, key string, id int64) (err error) {
+	err = c.fprintf("%s %s %d\r\n", command, key, id)
 	if err != nil {
 		log15.Error("glock client unlock error", "err ", err)
 		return err
 	}
 
-	splits, err := connection.readResponse()
+	splits, err := c.readResponse()
 	if err != nil {
 		log15.Error("glock client unlock readResponse error", "err", err)
 		return err
@@ -263,10 +724,90 @@ func (c *Client) Unlock(key string, id int64) (err error) {
 	return errors.New("Unknown reponse format")
 }
 
+// ReleaseSemaphore gives back the permits taken by the AcquireSemaphore that returned id.
+func (c *Client) ReleaseSemaphore(key string, id int64) (err error) {
+	connection, err := c.getConnection(key)
+	if err != nil {
+		return err
+	}
+	defer c.releaseConnection(connection)
+
+	err = connection.releaseSemaphore(key, id)
+	if c.followMoved(err, key) {
+		return c.ReleaseSemaphore(key, id)
+	}
+	return err
+}
+
+func (c *connection) releaseSemaphore(key string, id int64) (err error) {
+	err = c.fprintf("RELEASE %s %d\r\n", key, id)
+	if err != nil {
+		log15.Error("glock client release error", "err", err)
+		return err
+	}
+
+	splits, err := c.readResponse()
+	if err != nil {
+		log15.Error("glock client release readResponse error", "err", err)
+		return err
+	}
+
+	switch splits[0] {
+	case "NOT_RELEASED":
+		return errors.New("NOT_RELEASED")
+	case "RELEASED":
+		return nil
+	}
+	return errors.New("Unknown reponse format")
+}
+
+// Extend resets the timeout of a held lock to duration from now, as long as id
+// still holds it. It returns ErrNotExtended if the lock was unlocked or timed out.
+func (c *Client) Extend(key string, id int64, duration time.Duration) (err error) {
+	connection, err := c.getConnection(key)
+	if err != nil {
+		return err
+	}
+	defer c.releaseConnection(connection)
+
+	err = connection.extend(key, id, duration)
+	if c.followMoved(err, key) {
+		return c.Extend(key, id, duration)
+	}
+	return err
+}
+
+func (c *connection) extend(key string, id int64, duration time.Duration) (err error) {
+	err = c.fprintf("EXTEND %s %d %d\r\n", key, id, int(duration/time.Millisecond))
+	if err != nil {
+		log15.Error("glock client extend error", "err", err)
+		return err
+	}
+
+	splits, err := c.readResponse()
+	if err != nil {
+		log15.Error("glock client extend readResponse error", "err", err)
+		return err
+	}
+
+	switch splits[0] {
+	case "NOT_EXTENDED":
+		return ErrNotExtended
+	case "EXTENDED":
+		return nil
+	}
+	return errors.New("Unknown reponse format")
+}
+
 func (c *connection) fprintf(format string, a ...interface{}) error {
 	for i := 0; i < 3; i++ {
+		c.conn.SetWriteDeadline(c.deadline)
 		_, err := fmt.Fprintf(c.conn, format, a...)
 		if err != nil {
+			if isTimeout(err) {
+				c.broken = true
+				return &internalError{err}
+			}
 			err = c.redial()
 			if err != nil {
 				return &internalError{err}
@@ -279,14 +820,27 @@ func (c *connection) fprintf(format string, a ...interface{}) error {
 }
 
 func (c *connection) readResponse() (splits []string, err error) {
+	c.conn.SetReadDeadline(c.deadline)
 	splits, err = ReadSplits(c.reader)
 	if err != nil {
+		if isTimeout(err) {
+			c.broken = true
+		}
 		return nil, err
 	}
 
 	return splits, nil
 }
 
+// isTimeout reports whether err came from hitting a socket deadline.
+func isTimeout(err error) bool {
+	if connErr, ok := err.(*connectionError); ok {
+		err = connErr.error
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func (c *connection) redial() error {
 	c.conn.Close()
 	conn, err := dial(c.endpoint, c.client.username, c.client.password)
@@ -299,8 +853,75 @@ func (c *connection) redial() error {
 	return nil
 }
 
+// dial connects to endpoint, or to the first server of a failover group that
+// accepts connections, which is its primary: replicas only accept connections
+// once they take over.
 func dial(endpoint, username, password string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", endpoint)
+	addresses := strings.Split(endpoint, ",")
+	if len(addresses) == 1 {
+		return dialServer(endpoint, username, password)
+	}
+
+	deadline := time.Now().Add(failoverWait)
+	for {
+		var err error
+		for _, address := range addresses {
+			var conn net.Conn
+			if conn, err = dialLeader(address, username, password); err == nil {
+				return conn, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		// the primary may be gone before a replica took over, or the cluster may be electing a leader
+		time.Sleep(failoverRetry)
+	}
+}
+
+// dialLeader connects to the server at address, if it takes lock commands, or
+// to the cluster leader it redirects to.
+func dialLeader(address, username, password string) (net.Conn, error) {
+	for redirects := 0; ; redirects++ {
+		conn, err := dialServer(address, username, password)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(cancelTimeout))
+		splits, err := leader(conn)
+		conn.SetDeadline(time.Time{})
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		if len(splits) != 2 || redirects > 0 {
+			return nil, err
+		}
+		address = splits[1]
+	}
+}
+
+// leader sends a LEADER, and returns the response if it's a REDIRECT.
+func leader(conn net.Conn) (redirect []string, err error) {
+	if _, err := fmt.Fprintf(conn, "LEADER\r\n"); err != nil {
+		return nil, err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	splits := strings.Split(strings.TrimRight(response, "\r\n"), " ")
+	if splits[0] == "LEADER" {
+		return nil, nil
+	}
+	if splits[0] == "REDIRECT" {
+		return splits, errors.New("not the leader")
+	}
+	return nil, errors.New(strings.Join(splits, " "))
+}
+
+func dialServer(address, username, password string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
@@ -329,8 +950,18 @@ func ReadSplits(reader *bufio.Reader) ([]string, error) {
 
 	trimmedResponse := strings.TrimRight(response, "\r\n")
 	splits := strings.Split(trimmedResponse, " ")
+	if splits[0] == "REDIRECT" {
+		// a cluster server that isn't the leader, which closes the connection
+		return nil, &connectionError{errors.New(trimmedResponse)}
+	}
+	if splits[0] == "MOVED" && len(splits) == 2 {
+		return nil, &movedError{errors.New(trimmedResponse), splits[1]}
+	}
 	if splits[0] == "ERROR" {
-		if splits[1] == "503" {
+		switch splits[1] {
+		case "408":
+			return nil, &WaitTimeoutError{errors.New(trimmedResponse)}
+		case "503":
 			return nil, &CapacityError{errors.New(trimmedResponse)}
 		}
 		return nil, &internalError{errors.New(trimmedResponse)}
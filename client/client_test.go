@@ -3,6 +3,7 @@ package glock
 import (
 	"bufio"
 	"bytes"
+	"context"
 	cryptoRand "crypto/rand"
 	"fmt"
 	"math/rand"
@@ -181,6 +182,991 @@ func TestConcurrency(t *testing.T) {
 
 }
 
+func TestTryLock(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, ok, err := client1.TryLock(lockKey, 10*time.Second)
+	if err != nil || !ok {
+		t.Error("Expected to get free lock: ", ok, err)
+	}
+
+	_, ok, err = client1.TryLock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected trylock error: ", err)
+	}
+	if ok {
+		t.Error("Should not have gotten a held lock")
+	}
+
+	err = client1.Unlock(lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+
+	id2, ok, err := client1.TryLock(lockKey, 10*time.Second)
+	if err != nil || !ok {
+		t.Error("Expected to get released lock: ", ok, err)
+	}
+	err = client1.Unlock(lockKey, id2)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 2*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	start := time.Now()
+	_, err = client1.LockWait(lockKey, 10*time.Second, 500*time.Millisecond)
+	if _, ok := err.(*WaitTimeoutError); !ok {
+		t.Error("Expected wait timeout error got: ", err)
+	}
+	if waited := time.Since(start); waited < 500*time.Millisecond || waited > 1500*time.Millisecond {
+		t.Error("Expected to wait about 500ms, waited: ", waited)
+	}
+
+	// the first lock expires while we wait
+	id2, err := client1.LockWait(lockKey, 10*time.Second, 5*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+	if id2 == id1 {
+		t.Error("Expected a new lock id")
+	}
+	err = client1.Unlock(lockKey, id2)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+}
+
+func TestLockContext(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = client1.LockContext(ctx, lockKey, 10*time.Second)
+	if err != context.DeadlineExceeded {
+		t.Error("Expected deadline exceeded error got: ", err)
+	}
+
+	err = client1.UnlockContext(context.Background(), lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+
+	// the canceled request must not have been given the lock
+	id2, ok, err := client1.TryLock(lockKey, 10*time.Second)
+	if err != nil || !ok {
+		t.Error("Expected to get released lock: ", ok, err)
+	}
+	err = client1.Unlock(lockKey, id2)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 1*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		err = client1.Extend(lockKey, id1, 1*time.Second)
+		if err != nil {
+			t.Error("Unexpected extend error: ", err)
+		}
+	}
+
+	// still held well past the original timeout
+	_, ok, err := client1.TryLock(lockKey, 1*time.Second)
+	if err != nil || ok {
+		t.Error("Expected extended lock to still be held: ", ok, err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	err = client1.Extend(lockKey, id1, 1*time.Second)
+	if err != ErrNotExtended {
+		t.Error("Expected not extended error for timed out lock, got: ", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	lease, err := client1.Acquire(context.Background(), lockKey, 1*time.Second, LeaseOptions{AutoRenew: true})
+	if err != nil {
+		t.Fatal("Unexpected acquire error: ", err)
+	}
+	if lease.Key() != lockKey {
+		t.Error("Unexpected lease key: ", lease.Key())
+	}
+
+	select {
+	case <-lease.Lost():
+		t.Error("Auto renewed lease should not have been lost")
+	case <-time.After(2500 * time.Millisecond):
+	}
+	_, ok, err := client1.TryLock(lockKey, 1*time.Second)
+	if err != nil || ok {
+		t.Error("Expected renewed lease to still be held: ", ok, err)
+	}
+
+	err = lease.Unlock()
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+
+	lease, err = client1.Acquire(context.Background(), lockKey, 500*time.Millisecond, LeaseOptions{})
+	if err != nil {
+		t.Fatal("Unexpected acquire error: ", err)
+	}
+	select {
+	case <-lease.Lost():
+	case <-time.After(1500 * time.Millisecond):
+		t.Error("Expected lease without renewal to be lost")
+	}
+	err = lease.Extend(1 * time.Second)
+	if err != ErrNotExtended {
+		t.Error("Expected not extended error for lost lease, got: ", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	session := client1.NewSession(1 * time.Second)
+	_, err = session.Lock(lockKey, time.Minute)
+	if err != nil {
+		t.Error("Unexpected session lock error: ", err)
+	}
+
+	// still alive after a few heartbeats
+	time.Sleep(2 * time.Second)
+	_, ok, err := client1.TryLock(lockKey, time.Second)
+	if err != nil || ok {
+		t.Error("Expected session lock to still be held: ", ok, err)
+	}
+
+	err = session.Close()
+	if err != nil {
+		t.Error("Unexpected session close error: ", err)
+	}
+	id, ok, err := client1.TryLock(lockKey, time.Second)
+	if err != nil || !ok {
+		t.Error("Expected lock to be released with its session: ", ok, err)
+	}
+	client1.Unlock(lockKey, id)
+
+	// locks bound to a connection go away with it
+	server, _ := client1.consistent.Get(lockKey)
+	conn, err := dial(server, "test_username", "test_password")
+	if err != nil {
+		t.Fatal("Unexpected dial error: ", err)
+	}
+	fmt.Fprintf(conn, "LOCK %s 60000 session=conn\r\n", lockKey)
+	splits, err := ReadSplits(bufio.NewReader(conn))
+	if err != nil || splits[0] != "LOCKED" {
+		t.Error("Unexpected connection lock response: ", splits, err)
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	id, ok, err = client1.TryLock(lockKey, time.Second)
+	if err != nil || !ok {
+		t.Error("Expected lock to be released with its connection: ", ok, err)
+	}
+	client1.Unlock(lockKey, id)
+
+	// only the user that started a session may use it
+	conn, err = dial(server, "test_username", "test_password")
+	if err != nil {
+		t.Fatal("Unexpected dial error: ", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "SESSION 60000\r\n")
+	splits, err = ReadSplits(bufio.NewReader(conn))
+	if err != nil || splits[0] != "SESSION" {
+		t.Fatal("Unexpected session response: ", splits, err)
+	}
+	other, err := dial(server, "other_username", "other_password")
+	if err != nil {
+		t.Fatal("Unexpected dial error: ", err)
+	}
+	defer other.Close()
+	otherReader := bufio.NewReader(other)
+	for _, command := range []string{"LOCK " + lockKey + " 1000 session=" + splits[1], "ENDSESSION " + splits[1]} {
+		fmt.Fprintf(other, "%s\r\n", command)
+		if _, err := ReadSplits(otherReader); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Error("Expected another user's session to be off limits, got: ", err)
+		}
+	}
+	fmt.Fprintf(conn, "ENDSESSION %s\r\n", splits[1])
+}
+
+func TestDisconnectWhileWaiting(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	server, _ := client1.consistent.Get(lockKey)
+	conn, err := dial(server, "test_username", "test_password")
+	if err != nil {
+		t.Fatal("Unexpected dial error: ", err)
+	}
+	fmt.Fprintf(conn, "LOCK %s 60000\r\n", lockKey)
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	err = client1.Unlock(lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+
+	// the disconnected waiter must not have been given the lock
+	id2, ok, err := client1.TryLock(lockKey, 10*time.Second)
+	if err != nil || !ok {
+		t.Error("Expected to get released lock: ", ok, err)
+	}
+	client1.Unlock(lockKey, id2)
+}
+
+func TestFairQueue(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	var orderLock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		queued := make(chan int, 10)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := client1.LockQueued(context.Background(), lockKey, 10*time.Second, func(position int) {
+				queued <- position
+			})
+			if err != nil {
+				t.Error("Unexpected lock error: ", err)
+				return
+			}
+			orderLock.Lock()
+			order = append(order, i)
+			orderLock.Unlock()
+			client1.Unlock(lockKey, id)
+		}(i)
+
+		// wait until it's in line before queuing the next one
+		if position := <-queued; position != i+1 {
+			t.Error("Expected queue position ", i+1, " got: ", position)
+		}
+	}
+
+	err = client1.Unlock(lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Error("Expected locks in the order they were asked for, got: ", order)
+			break
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id1, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	var orderLock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	priorities := []int{0, 0, 5, 0, 10}
+	for i, priority := range priorities {
+		queued := make(chan int, 10)
+		wg.Add(1)
+		go func(i, priority int) {
+			defer wg.Done()
+			id, err := client1.LockWithOptions(context.Background(), lockKey, 10*time.Second, LockOptions{
+				Priority: priority,
+				Queued:   func(position int) { queued <- position },
+			})
+			if err != nil {
+				t.Error("Unexpected lock error: ", err)
+				return
+			}
+			orderLock.Lock()
+			order = append(order, i)
+			orderLock.Unlock()
+			client1.Unlock(lockKey, id)
+		}(i, priority)
+		<-queued
+	}
+
+	err = client1.Unlock(lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+	wg.Wait()
+	expected := []int{4, 2, 0, 1, 3}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Error("Expected locks by priority then in order ", expected, " got: ", order)
+			break
+		}
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	semKey := randString(10)
+	id1, err := client1.AcquireSemaphore(context.Background(), semKey, 2, 3, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected acquire error: ", err)
+	}
+	// expires on its own
+	_, err = client1.AcquireSemaphore(context.Background(), semKey, 1, 3, 500*time.Millisecond)
+	if err != nil {
+		t.Error("Unexpected acquire error: ", err)
+	}
+
+	if _, err := client1.AcquireSemaphore(context.Background(), semKey, 1, 4, 10*time.Second); err == nil {
+		t.Error("Expected acquire with another max to fail")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = client1.AcquireSemaphore(ctx, semKey, 1, 3, 10*time.Second)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Expected acquire to time out with all permits taken, got: ", err)
+	}
+
+	start := time.Now()
+	id3, err := client1.AcquireSemaphore(context.Background(), semKey, 1, 3, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected acquire error: ", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Error("Expected acquire to wait for the expiring permit")
+	}
+
+	if err := client1.Unlock(semKey, id1); err == nil {
+		t.Error("Expected Unlock of semaphore permits to fail")
+	}
+	err = client1.ReleaseSemaphore(semKey, id1)
+	if err != nil {
+		t.Error("Unexpected release error: ", err)
+	}
+	id4, err := client1.AcquireSemaphore(context.Background(), semKey, 2, 3, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected acquire error: ", err)
+	}
+
+	err = client1.ReleaseSemaphore(semKey, id1)
+	if err == nil {
+		t.Error("Expected error releasing permits twice")
+	}
+	client1.ReleaseSemaphore(semKey, id3)
+	client1.ReleaseSemaphore(semKey, id4)
+}
+
+func TestReadLock(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	rid1, err := client1.RLock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Error("Unexpected rlock error: ", err)
+	}
+	// expires on its own without releasing the other reader
+	_, err = client1.RLock(lockKey, 300*time.Millisecond)
+	if err != nil {
+		t.Error("Unexpected rlock error: ", err)
+	}
+
+	locked := make(chan int64)
+	go func() {
+		id, err := client1.Lock(lockKey, 10*time.Second)
+		if err != nil {
+			t.Error("Unexpected lock error: ", err)
+		}
+		locked <- id
+	}()
+
+	// the waiting writer keeps new readers out
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = client1.RLockContext(ctx, lockKey, 10*time.Second)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Expected rlock to wait behind the writer, got: ", err)
+	}
+
+	select {
+	case <-locked:
+		t.Error("Expected lock to wait for the remaining reader")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// a read lock is only released by RUnlock, and a lock only by Unlock
+	if err := client1.Unlock(lockKey, rid1); err == nil {
+		t.Error("Expected Unlock of a read lock to fail")
+	}
+	err = client1.RUnlock(lockKey, rid1)
+	if err != nil {
+		t.Error("Unexpected runlock error: ", err)
+	}
+	id := <-locked
+	if err := client1.RUnlock(lockKey, id); err == nil {
+		t.Error("Expected RUnlock of a lock to fail")
+	}
+	err = client1.Unlock(lockKey, id)
+	if err != nil {
+		t.Error("Unexpected unlock error: ", err)
+	}
+}
+
+func TestReentrantLock(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	opts := LockOptions{Owner: randString(10)}
+	id1, err := client1.LockWithOptions(context.Background(), lockKey, 10*time.Second, opts)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	id2, err := client1.LockWithOptions(ctx, lockKey, 10*time.Second, opts)
+	cancel()
+	if err != nil {
+		t.Error("Unexpected lock error by the same owner: ", err)
+	}
+	if id2 != id1 {
+		t.Error("Expected the same id for the same owner, got: ", id1, id2)
+	}
+
+	err = client1.Unlock(lockKey, id1)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+	if _, ok, _ := client1.TryLock(lockKey, 10*time.Second); ok {
+		t.Error("Expected lock to stay held until its last hold is unlocked")
+	}
+
+	err = client1.Unlock(lockKey, id2)
+	if err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+	id3, ok, err := client1.TryLock(lockKey, 10*time.Second)
+	if err != nil || !ok {
+		t.Error("Expected lock to be free after unlocking every hold: ", err)
+	}
+	client1.Unlock(lockKey, id3)
+}
+
+func TestLockMulti(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	keys := []string{randString(10), randString(10), randString(10), randString(10), randString(10)}
+	m, err := client1.LockMulti(keys, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected multi lock error: ", err)
+	}
+	for _, key := range keys {
+		if _, ok, _ := client1.TryLock(key, time.Second); ok {
+			t.Error("Expected multi lock to hold ", key)
+		}
+	}
+	err = m.Unlock()
+	if err != nil {
+		t.Error("Unexpected multi unlock error: ", err)
+	}
+
+	// overlapping multi locks in opposite orders don't deadlock
+	reversed := []string{keys[4], keys[3], keys[2], keys[1], keys[0]}
+	var wg sync.WaitGroup
+	for _, order := range [][]string{keys, reversed, keys[1:4], reversed[:3]} {
+		wg.Add(1)
+		go func(order []string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				m, err := client1.LockMulti(order, 10*time.Second)
+				if err != nil {
+					t.Error("Unexpected multi lock error: ", err)
+					return
+				}
+				m.Unlock()
+			}
+		}(order)
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		id, ok, err := client1.TryLock(key, time.Second)
+		if err != nil || !ok {
+			t.Error("Expected ", key, " to be unlocked: ", err)
+		}
+		client1.Unlock(key, id)
+	}
+}
+
+func TestLockQuorum(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+	if client1.fetchTopology(glockServers) != nil {
+		t.Skip("servers share a ring, so they aren't independent")
+	}
+	// a client per server, to lock keys on just one of them
+	servers := make([]*Client, len(glockServers))
+	for i, server := range glockServers {
+		servers[i], err = NewClient([]string{server}, 10, "test_username", "test_password")
+		if err != nil {
+			t.Error("Unexpected new client error: ", err)
+		}
+	}
+
+	lockKey := randString(10)
+	q, err := client1.LockQuorum(context.Background(), lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected quorum lock error: ", err)
+	}
+	if validity := q.Validity(); validity <= 0 || validity >= 10*time.Second {
+		t.Error("Unexpected quorum lock validity: ", validity)
+	}
+	for i, server := range servers {
+		if _, ok, _ := server.TryLock(lockKey, time.Second); ok {
+			t.Error("Expected quorum lock to be held on ", glockServers[i])
+		}
+	}
+	if _, err := client1.LockQuorum(context.Background(), lockKey, 10*time.Second); err != ErrNoQuorum {
+		t.Error("Expected no quorum error for held lock, got: ", err)
+	}
+	err = q.Unlock()
+	if err != nil {
+		t.Error("Unexpected quorum unlock error: ", err)
+	}
+
+	// a minority holding the key doesn't keep the others from granting it
+	lockKey = randString(10)
+	id, err := servers[0].Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected lock error: ", err)
+	}
+	q, err = client1.LockQuorum(context.Background(), lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected quorum lock error: ", err)
+	}
+	q.Unlock()
+
+	// a majority does, and the partial grant is released
+	id2, err := servers[1].Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected lock error: ", err)
+	}
+	if _, err := client1.LockQuorum(context.Background(), lockKey, 10*time.Second); err != ErrNoQuorum {
+		t.Error("Expected no quorum error, got: ", err)
+	}
+	id3, ok, err := servers[2].TryLock(lockKey, time.Second)
+	if err != nil || !ok {
+		t.Error("Expected partial quorum lock to be released: ", err)
+	}
+	servers[0].Unlock(lockKey, id)
+	servers[1].Unlock(lockKey, id2)
+	servers[2].Unlock(lockKey, id3)
+
+	// a lock that can't be acquired within its validity isn't held
+	if _, err := client1.LockQuorum(context.Background(), randString(10), time.Millisecond); err != ErrNoQuorum {
+		t.Error("Expected no quorum error for a lock shorter than the drift, got: ", err)
+	}
+}
+
+func TestFencingTokens(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	var last int64
+	for i := 0; i < 10; i++ {
+		// alternate between a lease that's unlocked and one that times out
+		duration := 10 * time.Second
+		if i%2 == 1 {
+			duration = 10 * time.Millisecond
+		}
+		lease, err := client1.Acquire(context.Background(), lockKey, duration, LeaseOptions{})
+		if err != nil {
+			t.Fatal("Unexpected acquire error: ", err)
+		}
+		if lease.Fence() <= last {
+			t.Error("Expected increasing fencing tokens, got ", lease.Fence(), " after ", last)
+		}
+		last = lease.Fence()
+		if i%2 == 0 {
+			lease.Unlock()
+		}
+	}
+
+	// a key that was never locked before still continues from there
+	lease, err := client1.Acquire(context.Background(), randString(10), time.Second, LeaseOptions{})
+	if err != nil {
+		t.Fatal("Unexpected acquire error: ", err)
+	}
+	if lease.Fence() <= last {
+		t.Error("Expected a new key's fencing token to be larger than older ones, got ", lease.Fence(), " after ", last)
+	}
+	lease.Unlock()
+}
+
+func TestLockOwnership(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+	client2, err := NewClient(glockServers, 10, "other_username", "other_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	lockKey := randString(10)
+	id, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected lock error: ", err)
+	}
+
+	// neither a nearby id nor the right id unlocks it for somebody else
+	if err := client1.Unlock(lockKey, id+1); err == nil {
+		t.Error("Expected unlock with a guessed id to fail")
+	}
+	if err := client2.Unlock(lockKey, id); err == nil {
+		t.Error("Expected unlock by another user to fail")
+	}
+	if err := client2.Extend(lockKey, id, time.Second); err == nil || err == ErrNotExtended {
+		t.Error("Expected extend by another user to be rejected, got: ", err)
+	}
+	if _, ok, _ := client2.TryLock(lockKey, time.Second); ok {
+		t.Error("Expected lock to still be held")
+	}
+
+	if err := client1.Unlock(lockKey, id); err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+}
+
+// TestSweep expects servers configured with a short sweep_interval.
+func TestSweep(t *testing.T) {
+	client1, err := NewClient(glockServers, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+	liveLocks := func() int64 {
+		var live int64
+		for _, endpoint := range glockServers {
+			stats, err := client1.ServerStats(endpoint)
+			if err != nil {
+				t.Fatal("Unexpected stats error: ", err)
+			}
+			live += stats["locks"]
+		}
+		return live
+	}
+
+	keys := make([]string, 30)
+	ids := make([]int64, len(keys))
+	for i := range keys {
+		keys[i] = randString(10)
+		ids[i], err = client1.Lock(keys[i], 10*time.Second)
+		if err != nil {
+			t.Fatal("Unexpected lock error: ", err)
+		}
+	}
+	held := liveLocks()
+	if held < int64(len(keys)) {
+		t.Error("Expected at least ", len(keys), " live locks, got: ", held)
+	}
+	for i, key := range keys {
+		client1.Unlock(key, ids[i])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for live := liveLocks(); live > held-int64(len(keys)); live = liveLocks() {
+		if time.Now().After(deadline) {
+			if live >= held {
+				t.Skip("servers don't sweep within the test, their sweep_interval is too long")
+			}
+			t.Fatal("Expected unlocked keys to be swept, live locks: ", live, " were: ", held)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// unlocking a swept key again doesn't find it held
+	if err := client1.Unlock(keys[1], ids[1]); err == nil || err.Error() != "NOT_UNLOCKED" {
+		t.Error("Expected NOT_UNLOCKED for swept key, got: ", err)
+	}
+
+	// swept keys can be locked again
+	id, err := client1.Lock(keys[0], time.Second)
+	if err != nil {
+		t.Error("Unexpected lock error: ", err)
+	}
+	client1.Unlock(keys[0], id)
+}
+
+func TestRehomeDelay(t *testing.T) {
+	// a server that lets clients in, then hangs up on the first command
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					split := strings.Fields(scanner.Text())
+					if split[0] != "AUTH" {
+						return
+					}
+					if len(split) == 2 {
+						fmt.Fprintf(conn, "a2V5\r\n")
+					} else {
+						fmt.Fprintf(conn, "AUTHORIZED\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	failing := listener.Addr().String()
+
+	const delay = time.Second
+	client1, err := NewClientWithOptions(append([]string{failing}, glockServers...), 10, "test_username", "test_password", ClientOptions{RehomeDelay: delay})
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+	if client1.fetchTopology(glockServers) != nil {
+		t.Skip("servers know their ring, which leaves out the failing server")
+	}
+	var lockKey string
+	for server := ""; server != failing; server, _ = client1.consistent.Get(lockKey) {
+		lockKey = randString(10)
+	}
+
+	failed := time.Now()
+	_, err = client1.Lock(lockKey, delay)
+	if _, ok := err.(*UnavailableError); !ok {
+		t.Fatal("Expected unavailable error for key of failed server, got: ", err)
+	}
+	if _, _, err := client1.TryLock(lockKey, delay); err == nil {
+		t.Error("Expected key of failed server to stay unavailable")
+	}
+	time.Sleep(delay - time.Since(failed) + 100*time.Millisecond)
+	id, err := client1.Lock(lockKey, delay)
+	if err != nil {
+		t.Fatal("Expected key to move to another server after the delay, got: ", err)
+	}
+	if err := client1.Unlock(lockKey, id); err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+
+	// coming back, the server waits as well
+	client1.addEndpoints([]string{failing}, true)
+	if _, err := client1.Lock(lockKey, delay); err == nil {
+		t.Error("Expected key of rejoined server to be unavailable")
+	} else if _, ok := err.(*UnavailableError); !ok {
+		t.Error("Expected unavailable error for key of rejoined server, got: ", err)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	client1, err := NewClient(glockServers[:1], 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+	if len(client1.endpointList()) == 1 {
+		t.Skip("servers don't know their ring")
+	}
+	client2, err := NewClient([]string{glockServers[2], glockServers[1], glockServers[0]}, 10, "test_username", "test_password")
+	if err != nil {
+		t.Error("Unexpected new client error: ", err)
+	}
+
+	// a client whose ring is missing a server gets its keys moved back to it
+	removed := client1.endpointList()[1]
+	client1.removeEndpoint(removed)
+	var lockKey string
+	for server := ""; server != removed; server, _ = client2.consistent.Get(lockKey) {
+		lockKey = randString(10)
+	}
+	id, err := client1.Lock(lockKey, 10*time.Second)
+	if err != nil {
+		t.Fatal("Unexpected lock error: ", err)
+	}
+	if _, ok, _ := client2.TryLock(lockKey, time.Second); ok {
+		t.Error("Expected clients to agree on the server of ", lockKey)
+	}
+	if err := client2.Unlock(lockKey, id); err != nil {
+		t.Error("Unexpected Unlock error: ", err)
+	}
+}
+
+// fakeResolver resolves every name to its endpoints.
+type fakeResolver struct {
+	mu        sync.Mutex
+	endpoints []string
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endpoints, nil
+}
+
+func (r *fakeResolver) set(endpoints ...string) {
+	r.mu.Lock()
+	r.endpoints = endpoints
+	r.mu.Unlock()
+}
+
+func TestDiscovery(t *testing.T) {
+	resolver := &fakeResolver{}
+	opts := ClientOptions{Discover: "_glock._tcp.example.com", Resolver: resolver, DiscoveryInterval: 50 * time.Millisecond}
+	if _, err := NewClientWithOptions(nil, 10, "test_username", "test_password", opts); err == nil {
+		t.Error("Expected error for a name without servers")
+	}
+
+	resolver.set(glockServers[0])
+	client1, err := NewClientWithOptions(nil, 10, "test_username", "test_password", opts)
+	if err != nil {
+		t.Fatal("Unexpected new client error: ", err)
+	}
+	if client1.fetchTopology(glockServers) != nil {
+		t.Skip("servers know their ring, which takes the place of the records")
+	}
+	members := func(want ...string) {
+		for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+			if len(downServers(want, client1.consistent.Members())) == 0 && len(client1.consistent.Members()) == len(want) {
+				return
+			}
+		}
+		t.Fatal("Expected endpoints ", want, ", got ", client1.consistent.Members())
+	}
+	members(glockServers[0])
+
+	resolver.set(glockServers...)
+	members(glockServers...)
+	resolver.set(glockServers[1], glockServers[2])
+	members(glockServers[1], glockServers[2])
+
+	// a failed lookup keeps the servers
+	resolver.set()
+	time.Sleep(200 * time.Millisecond)
+	members(glockServers[1], glockServers[2])
+
+	id, err := client1.Lock("discovered", time.Second)
+	if err != nil {
+		t.Fatal("Unexpected lock error: ", err)
+	}
+	client1.Unlock("discovered", id)
+}
+
+func TestDNSResolver(t *testing.T) {
+	endpoints, err := (&DNSResolver{}).Resolve(context.Background(), "localhost:45625")
+	if err != nil {
+		t.Fatal("Unexpected resolve error: ", err)
+	}
+	found := false
+	for _, endpoint := range endpoints {
+		found = found || endpoint == "127.0.0.1:45625"
+	}
+	if !found {
+		t.Error("Expected localhost to resolve to 127.0.0.1:45625, got ", endpoints)
+	}
+}
+
 func TestServerDrop(t *testing.T) {
 	client1, err := NewClient(glockServers, 500, "test_username", "test_password")
 	if err != nil {
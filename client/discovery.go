@@ -0,0 +1,93 @@
+package glock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Resolver looks up the endpoints of the glock servers behind a name, see ClientOptions.Discover.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (endpoints []string, err error)
+}
+
+// DNSResolver resolves SRV names to the targets and ports of their records, and
+// host:port names to the addresses of the host's A and AAAA records.
+type DNSResolver struct {
+	// Resolver does the lookups, net.DefaultResolver if nil.
+	Resolver *net.Resolver
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context, name string) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make([]string, len(addrs))
+		for i, addr := range addrs {
+			endpoints[i] = net.JoinHostPort(addr, port)
+		}
+		return endpoints, nil
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(records))
+	for i, record := range records {
+		endpoints[i] = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+	}
+	return endpoints, nil
+}
+
+// how long a lookup may take
+const resolveTimeout = 10 * time.Second
+
+// resolve looks up name with resolver, failing if it has no endpoints.
+func resolve(resolver Resolver, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	endpoints, err := resolver.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no glock servers found for " + name)
+	}
+	return endpoints, nil
+}
+
+// discover looks up name every interval, and adds and removes endpoints as it changes.
+func (c *Client) discover(resolver Resolver, name string, interval time.Duration) {
+	for range time.Tick(interval) {
+		c.rediscover(resolver, name)
+	}
+}
+
+func (c *Client) rediscover(resolver Resolver, name string) {
+	endpoints, err := resolve(resolver, name)
+	if err != nil {
+		// keep the servers we know about, rather than dropping them all
+		log15.Error("glock client discovery error", "name", name, "err", err)
+		return
+	}
+	if topology := c.fetchTopology(endpoints); topology != nil {
+		// the servers know better which of them share the keys
+		endpoints = topology
+	}
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	c.setEndpoints(endpoints)
+}
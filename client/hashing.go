@@ -1,6 +1,11 @@
 package glock
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -12,9 +17,9 @@ func (c *Client) CheckServerStatus() {
 		ticker := time.Tick(60 * time.Second)
 		for _ = range ticker {
 			members := c.consistent.Members()
-			down := downServers(c.endpoints, members)
+			down := downServers(c.endpointList(), members)
 			if len(down) > 0 {
-				c.addEndpoints(down)
+				c.addEndpoints(down, true)
 			}
 
 			serverStatuses := make([]interface{}, 4*len(members))
@@ -22,7 +27,14 @@ func (c *Client) CheckServerStatus() {
 				c.poolsLock.RLock()
 				availableConns := len(c.connectionPools[server])
 				c.poolsLock.RUnlock()
-				totalConns := int(atomic.LoadInt32(c.connectionCount[server])) + availableConns
+				c.countLock.RLock()
+				count := c.connectionCount[server]
+				c.countLock.RUnlock()
+				totalConns := availableConns
+				if count != nil {
+					// a quarantined endpoint stays in the ring without connections
+					totalConns += int(atomic.LoadInt32(count))
+				}
 				j := 4 * i
 				serverStatuses[j+0] = server + "_available"
 				serverStatuses[j+1] = availableConns
@@ -34,6 +46,123 @@ func (c *Client) CheckServerStatus() {
 	}()
 }
 
+// endpointList returns the endpoints the client spreads keys over.
+func (c *Client) endpointList() []string {
+	c.endpointsLock.RLock()
+	defer c.endpointsLock.RUnlock()
+	return c.endpoints
+}
+
+// fetchTopology asks the endpoints for the ring the servers share, and returns
+// its endpoints, or nil if the servers don't know it.
+func (c *Client) fetchTopology(endpoints []string) []string {
+	for _, endpoint := range endpoints {
+		conn, err := dial(endpoint, c.username, c.password)
+		if err != nil {
+			log15.Error("glock client error asking for topology", "endpoint", endpoint, "err", err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(cancelTimeout))
+		_, err = fmt.Fprintf(conn, "TOPOLOGY\r\n")
+		var splits []string
+		if err == nil {
+			splits, err = ReadSplits(bufio.NewReader(conn))
+		}
+		conn.Close()
+		if err != nil || splits[0] != "TOPOLOGY" {
+			// a server from before TOPOLOGY doesn't know the ring either
+			log15.Error("glock client error asking for topology", "endpoint", endpoint, "err", err)
+			continue
+		}
+		if len(splits) == 1 {
+			return nil
+		}
+		return splits[1:]
+	}
+	return nil
+}
+
+// followMoved handles err if it's a MOVED response for one of keys: it rebuilds
+// the hash ring from the servers' topology, and reports whether one of keys now
+// goes to the server the key was moved to, so that it's worth trying again.
+func (c *Client) followMoved(err error, keys ...string) bool {
+	moved, ok := err.(*movedError)
+	if !ok {
+		return false
+	}
+	c.refreshTopology()
+	for _, key := range keys {
+		if server, err := c.consistent.Get(key); err == nil && server == moved.endpoint {
+			return true
+		}
+	}
+	log15.Error("glock client key moved to a server outside of the ring", "endpoint", moved.endpoint, "keys", keys)
+	return false
+}
+
+// refreshTopology rebuilds the hash ring from the servers' topology.
+func (c *Client) refreshTopology() {
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	if topology := c.fetchTopology(c.endpointList()); topology != nil {
+		c.setEndpoints(topology)
+	}
+}
+
+// setEndpoints makes endpoints the ones the client spreads keys over, adding
+// and removing them in the hash ring. c.ringLock must be held.
+func (c *Client) setEndpoints(endpoints []string) {
+	c.endpointsLock.Lock()
+	c.endpoints = endpoints
+	c.endpointsLock.Unlock()
+
+	// endpoints that were taken out of the ring for failing come back as well
+	members := c.consistent.Members()
+	removed := downServers(members, endpoints)
+	added := downServers(endpoints, members)
+	for _, endpoint := range removed {
+		c.removeEndpoint(endpoint)
+	}
+	c.addEndpoints(added, true)
+	if len(removed) > 0 || len(added) > 0 {
+		log15.Info("glock client updated endpoints", "endpoints", endpoints, "added", added, "removed", removed)
+	}
+}
+
+// ServerStats returns the statistics the server at endpoint keeps about itself,
+// such as "locks", the number of keys it currently keeps a lock for.
+func (c *Client) ServerStats(endpoint string) (map[string]int64, error) {
+	connection, err := c.getServerConnection(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer c.releaseConnection(connection)
+
+	err = connection.fprintf("STATS\r\n")
+	if err != nil {
+		return nil, err
+	}
+	splits, err := connection.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if splits[0] != "STATS" {
+		return nil, &internalError{errors.New("Unknown reponse format")}
+	}
+
+	stats := make(map[string]int64, len(splits)-1)
+	for _, stat := range splits[1:] {
+		kv := strings.SplitN(stat, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+			stats[kv[0]] = value
+		}
+	}
+	return stats, nil
+}
+
 func downServers(endpoints, upServers []string) (downServers []string) {
 	for _, endpoint := range endpoints {
 		isUp := false
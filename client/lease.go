@@ -0,0 +1,195 @@
+package glock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// LeaseOptions configures a lease taken out with Acquire.
+type LeaseOptions struct {
+	LockOptions
+
+	// AutoRenew extends the lease in the background every third of its
+	// duration until it's unlocked or lost.
+	AutoRenew bool
+}
+
+// Lease is a held lock that knows its own key and id.
+type Lease struct {
+	client    *Client
+	key       string
+	id        int64
+	fence     int64
+	duration  time.Duration
+	autoRenew bool
+
+	mu      sync.Mutex
+	expires time.Time // when the lease runs out, as far as the client knows
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Acquire waits for the lock on key like LockWithOptions and returns it as a Lease
+// that is held for duration, or for as long as it keeps being extended.
+func (c *Client) Acquire(ctx context.Context, key string, duration time.Duration, opts LeaseOptions) (*Lease, error) {
+	// The server starts timing the lease out before its response gets here, so
+	// the lease runs out duration after the request was sent, as for Extend. A
+	// request that had to wait is timed from when it was granted instead, which
+	// is at least the time the server took to tell it it's queued before the
+	// response.
+	start := time.Now()
+	var queuedAt time.Time
+	lockOpts := opts.LockOptions
+	lockOpts.Queued = func(position int) {
+		if queuedAt.IsZero() {
+			queuedAt = time.Now()
+		}
+		if opts.Queued != nil {
+			opts.Queued(position)
+		}
+	}
+	id, fence, err := c.lockWithOptions(ctx, key, duration, lockOpts)
+	if err != nil {
+		return nil, err
+	}
+	expires := start.Add(duration)
+	if !queuedAt.IsZero() {
+		expires = time.Now().Add(duration - queuedAt.Sub(start))
+	}
+
+	l := &Lease{
+		client:    c,
+		key:       key,
+		id:        id,
+		fence:     fence,
+		duration:  duration,
+		autoRenew: opts.AutoRenew,
+		expires:   expires,
+		lost:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	go l.watch()
+	return l, nil
+}
+
+// Key returns the key the lease holds the lock on.
+func (l *Lease) Key() string {
+	return l.key
+}
+
+// Token returns the lock id the server issued for the lease. It's an opaque
+// token that only unlocks or extends the lease for the user who acquired it.
+func (l *Lease) Token() int64 {
+	return l.id
+}
+
+// Fence returns the lease's fencing token. Every lock on the key gets a larger
+// token than the ones before it, also across server restarts and, as long as the
+// servers' clocks are in sync, after the key moves to another server. A store that
+// remembers the largest token it has seen can reject writes from a client whose
+// lease ran out while it was paused.
+func (l *Lease) Fence() int64 {
+	return l.fence
+}
+
+// Lost returns a channel that is closed once the lease is no longer held,
+// either because it ran out or because it couldn't be renewed. It isn't
+// closed by Unlock.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Extend resets the lease to run out duration from now. It returns ErrNotExtended,
+// and the lease is lost, if the server no longer holds the lock for it.
+func (l *Lease) Extend(duration time.Duration) error {
+	start := time.Now()
+	err := l.client.Extend(l.key, l.id, duration)
+	if err == ErrNotExtended {
+		l.setLost()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.expires = start.Add(duration)
+	l.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the lease and stops renewing it.
+func (l *Lease) Unlock() error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	return l.client.Unlock(l.key, l.id)
+}
+
+func (l *Lease) setLost() {
+	select {
+	case <-l.stop:
+		// unlocked on purpose
+		return
+	default:
+	}
+	l.lostOnce.Do(func() {
+		log15.Info("glock client lease lost", "key", l.key, "id", l.id)
+		close(l.lost)
+	})
+}
+
+// watch marks the lease lost once it runs out, renewing it first if asked to.
+func (l *Lease) watch() {
+	renewInterval := l.duration / 3
+	// renew a third of the way into the lease, as timed by expires
+	renewAfter := func() time.Time {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.expires.Add(renewInterval - l.duration)
+	}
+	nextRenew := renewAfter()
+	for {
+		l.mu.Lock()
+		expires := l.expires
+		l.mu.Unlock()
+
+		wake := expires
+		if l.autoRenew && nextRenew.Before(wake) {
+			wake = nextRenew
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-l.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		l.mu.Lock()
+		expires = l.expires
+		l.mu.Unlock()
+		if !time.Now().Before(expires) {
+			l.setLost()
+			return
+		}
+
+		if l.autoRenew && !time.Now().Before(nextRenew) {
+			err := l.Extend(l.duration)
+			if err == ErrNotExtended {
+				return
+			}
+			if err != nil {
+				// try again soon; the lease is only lost once it runs out
+				log15.Error("glock client lease renew error", "key", l.key, "id", l.id, "err", err)
+				nextRenew = time.Now().Add(renewInterval / 3)
+				continue
+			}
+			nextRenew = renewAfter()
+		}
+	}
+}
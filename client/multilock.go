@@ -0,0 +1,149 @@
+package glock
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// MultiLock holds the locks on several keys, taken together by LockMulti.
+type MultiLock struct {
+	client *Client
+	keys   []string
+	ids    []int64
+	fences []int64
+}
+
+// Keys returns the locked keys.
+func (m *MultiLock) Keys() []string {
+	return m.keys
+}
+
+// ID returns the lock id key is held with, or 0 if the MultiLock doesn't hold key.
+func (m *MultiLock) ID(key string) int64 {
+	for i, k := range m.keys {
+		if k == key {
+			return m.ids[i]
+		}
+	}
+	return 0
+}
+
+// Fence returns the fencing token of the lock on key, see Lease.Fence, or 0 if
+// the MultiLock doesn't hold key.
+func (m *MultiLock) Fence(key string) int64 {
+	for i, k := range m.keys {
+		if k == key {
+			return m.fences[i]
+		}
+	}
+	return 0
+}
+
+// Unlock releases all of the locks, returning the first error.
+func (m *MultiLock) Unlock() error {
+	var firstErr error
+	for i, key := range m.keys {
+		if err := m.client.Unlock(key, m.ids[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// LockMulti locks all of keys for duration, or none of them. Keys that live on
+// the same server are locked there in a single command, and servers are visited
+// in a fixed order, so LockMulti calls with overlapping keys can't deadlock each
+// other. If a server fails, the locks taken so far are released again.
+func (c *Client) LockMulti(keys []string, duration time.Duration) (*MultiLock, error) {
+	byServer := make(map[string][]string)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		server, err := c.serverFor(key)
+		if err != nil {
+			return nil, err
+		}
+		byServer[server] = append(byServer[server], key)
+	}
+	servers := make([]string, 0, len(byServer))
+	for server := range byServer {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	m := &MultiLock{client: c}
+	for _, server := range servers {
+		serverKeys := byServer[server]
+		ids, fences, err := c.lockMultiOn(server, serverKeys, duration)
+		if err != nil {
+			if unlockErr := m.Unlock(); unlockErr != nil {
+				log15.Error("glock client error rolling back multi lock", "keys", m.keys, "err", unlockErr)
+			}
+			if c.followMoved(err, serverKeys...) {
+				return c.LockMulti(keys, duration)
+			}
+			if _, ok := err.(*connectionError); ok {
+				log15.Error("glock client connection error, couldn't get multi lock. Removing endpoint from hash table", "server", server, "err", err)
+				c.endpointFailed(server)
+				return c.LockMulti(keys, duration)
+			}
+			log15.Error("glock client error trying to get multi lock", "endpoint", server, "err", err)
+			return nil, err
+		}
+		m.keys = append(m.keys, serverKeys...)
+		m.ids = append(m.ids, ids...)
+		m.fences = append(m.fences, fences...)
+	}
+	return m, nil
+}
+
+func (c *Client) lockMultiOn(server string, keys []string, duration time.Duration) (ids, fences []int64, err error) {
+	connection, err := c.getServerConnection(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.releaseConnection(connection)
+
+	return connection.lockMulti(keys, duration)
+}
+
+// lockMulti sends an MLOCK, which responds with a lock id and fencing token per key.
+func (c *connection) lockMulti(keys []string, duration time.Duration) (ids, fences []int64, err error) {
+	err = c.fprintf("MLOCK %d %d %s\r\n", int(duration/time.Millisecond), len(keys), strings.Join(keys, " "))
+	if err != nil {
+		log15.Error("glock client multi lock error", "err", err)
+		return nil, nil, err
+	}
+
+	splits, err := c.readResponse()
+	if err != nil {
+		log15.Error("glock client multi lock readResponse", "err", err)
+		return nil, nil, err
+	}
+	if splits[0] != "LOCKED" || len(splits) != 2*len(keys)+1 {
+		return nil, nil, &internalError{errors.New("Unknown reponse format")}
+	}
+
+	ids = make([]int64, len(keys))
+	fences = make([]int64, len(keys))
+	for i := range keys {
+		ids[i], err = strconv.ParseInt(splits[2*i+1], 10, 64)
+		if err != nil {
+			return nil, nil, &internalError{fmt.Errorf("bad lock id %q", splits[2*i+1])}
+		}
+		fences[i], err = strconv.ParseInt(splits[2*i+2], 10, 64)
+		if err != nil {
+			return nil, nil, &internalError{fmt.Errorf("bad fencing token %q", splits[2*i+2])}
+		}
+	}
+	return ids, fences, nil
+}
@@ -0,0 +1,154 @@
+package glock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrNoQuorum is returned by LockQuorum when a majority of the endpoints didn't
+// grant the lock in time.
+var ErrNoQuorum = errors.New("lock not granted by a majority of the servers")
+
+// The servers time out a quorum lock by their own clocks, which may run faster
+// than the client's. Validity sets this fraction of the duration aside for that,
+// plus quorumDriftMin, the way Redlock does.
+const (
+	quorumDriftFactor = 0.01
+	quorumDriftMin    = 2 * time.Millisecond
+)
+
+// QuorumLock is a lock held on a majority of the client's endpoints, taken by LockQuorum.
+type QuorumLock struct {
+	client     *Client
+	key        string
+	ids        map[string]int64 // lock ids by the endpoint that granted them
+	validUntil time.Time
+}
+
+// Key returns the locked key.
+func (q *QuorumLock) Key() string {
+	return q.key
+}
+
+// Validity returns how much longer the lock is safe to rely on: its duration,
+// less the time it took to acquire and an allowance for the servers' clocks
+// drifting. Once it's 0, a majority of the servers may have timed it out.
+func (q *QuorumLock) Validity() time.Duration {
+	if validity := time.Until(q.validUntil); validity > 0 {
+		return validity
+	}
+	return 0
+}
+
+// Unlock releases the lock on every endpoint that granted it, returning the first error.
+func (q *QuorumLock) Unlock() error {
+	return q.client.unlockQuorum(q.key, q.ids)
+}
+
+// LockQuorum locks key for duration on all of the client's endpoints at once,
+// as an alternative to replicated servers: the endpoints are independent
+// servers, and the lock is held once a majority of them granted it. Servers that
+// already have key locked don't wait for it, and servers that don't answer
+// within duration count as not granting it. If no majority granted the lock, or
+// acquiring it took longer than its validity allows for, the partial grants are
+// released again and LockQuorum returns ErrNoQuorum. Servers that share a ring
+// move keys to the server that owns them instead, so they don't make a quorum.
+// ctx's deadline also bounds the socket I/O.
+func (c *Client) LockQuorum(ctx context.Context, key string, duration time.Duration) (*QuorumLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(duration)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ids := make(map[string]int64)
+	endpoints := c.endpointList()
+	for _, endpoint := range endpoints {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			id, err := c.lockOn(endpoint, key, duration, deadline)
+			if err != nil {
+				log15.Debug("glock client quorum lock not granted", "endpoint", endpoint, "key", key, "err", err)
+				return
+			}
+			mu.Lock()
+			ids[endpoint] = id
+			mu.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+
+	drift := time.Duration(float64(duration)*quorumDriftFactor) + quorumDriftMin
+	q := &QuorumLock{client: c, key: key, ids: ids, validUntil: start.Add(duration - drift)}
+	if len(ids) <= len(endpoints)/2 || q.Validity() == 0 {
+		if err := c.unlockQuorum(key, ids); err != nil {
+			log15.Error("glock client error releasing partial quorum lock", "key", key, "err", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoQuorum
+	}
+	return q, nil
+}
+
+// lockOn sends a LOCK for key to endpoint that doesn't wait for the lock, and
+// gives up on the connection at deadline.
+func (c *Client) lockOn(endpoint, key string, duration time.Duration, deadline time.Time) (id int64, err error) {
+	connection, err := c.getServerConnection(endpoint)
+	if err != nil {
+		return id, err
+	}
+	defer c.releaseConnection(connection)
+
+	connection.deadline = deadline
+	id, _, err = connection.lock(context.Background(), key, "LOCK "+key, duration, nil, []string{"wait=0"})
+	if err, ok := err.(*connectionError); ok {
+		log15.Error("glock client connection error, couldn't get quorum lock. Removing endpoint from hash table", "server", endpoint, "err", err)
+		connection.broken = true
+		c.endpointFailed(endpoint)
+	}
+	return id, err
+}
+
+// unlockQuorum releases the locks on key held with ids on their endpoints.
+func (c *Client) unlockQuorum(key string, ids map[string]int64) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for endpoint, id := range ids {
+		wg.Add(1)
+		go func(endpoint string, id int64) {
+			defer wg.Done()
+			err := c.unlockOn(endpoint, key, id)
+			mu.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(endpoint, id)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (c *Client) unlockOn(endpoint, key string, id int64) error {
+	connection, err := c.getServerConnection(endpoint)
+	if err != nil {
+		return err
+	}
+	defer c.releaseConnection(connection)
+
+	return connection.unlock("UNLOCK", key, id)
+}
@@ -0,0 +1,174 @@
+package glock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrSessionClosed is returned when locking through a Session that was closed.
+var ErrSessionClosed = errors.New("session closed")
+
+// Session ties locks to the client staying alive. Each server that one of the
+// session's locks lives on keeps a session of its own, which is kept alive in
+// the background. If the heartbeats stop, e.g. because the process died, the
+// servers release the session's locks right away instead of when they time out.
+type Session struct {
+	client *Client
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	ids    map[string]string // the server's session id, by endpoint
+	closed bool
+	stop   chan struct{}
+}
+
+// NewSession starts a session that servers end once they haven't heard from it for ttl.
+func (c *Client) NewSession(ttl time.Duration) *Session {
+	s := &Session{client: c, ttl: ttl, ids: make(map[string]string), stop: make(chan struct{})}
+	go s.keepAlive()
+	return s
+}
+
+// Lock is like Client.Lock, but the lock is also released when the session ends.
+// Unlock it with Client.Unlock as usual.
+func (s *Session) Lock(key string, duration time.Duration) (id int64, err error) {
+	return s.LockContext(context.Background(), key, duration)
+}
+
+// LockContext is like Client.LockContext, but the lock is also released when the session ends.
+func (s *Session) LockContext(ctx context.Context, key string, duration time.Duration) (id int64, err error) {
+	connection, err := s.client.getConnection(key)
+	if err != nil {
+		return id, err
+	}
+	defer s.client.releaseConnection(connection)
+
+	for retried := false; ; retried = true {
+		sessionID, err := s.serverID(connection)
+		if err != nil {
+			return id, err
+		}
+
+		id, _, err = connection.lock(ctx, key, "LOCK "+key, duration, nil, []string{"session=" + sessionID})
+		if isSessionNotFound(err) && !retried {
+			// the server ended it, probably after missing heartbeats; start over
+			s.forget(connection.endpoint, sessionID)
+			continue
+		}
+		if err != nil {
+			log15.Error("glock client error trying to get session lock", "endpoint", connection.endpoint, "err", err)
+		}
+		return id, err
+	}
+}
+
+// Close ends the session, releasing all of its locks.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	ids := s.ids
+	s.ids = nil
+	s.mu.Unlock()
+
+	var firstErr error
+	for endpoint, sessionID := range ids {
+		err := s.client.serverCommand(endpoint, "ENDSESSION", sessionID)
+		if err != nil && !isSessionNotFound(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// serverID returns the session's id on connection's server, starting a session there if needed.
+func (s *Session) serverID(connection *connection) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return "", ErrSessionClosed
+	}
+	if sessionID, ok := s.ids[connection.endpoint]; ok {
+		return sessionID, nil
+	}
+
+	err := connection.fprintf("SESSION %d\r\n", int(s.ttl/time.Millisecond))
+	if err != nil {
+		return "", err
+	}
+	splits, err := connection.readResponse()
+	if err != nil {
+		return "", err
+	}
+	if splits[0] != "SESSION" || len(splits) < 2 {
+		return "", &internalError{errors.New("Unknown reponse format")}
+	}
+	s.ids[connection.endpoint] = splits[1]
+	return splits[1], nil
+}
+
+func (s *Session) forget(endpoint, sessionID string) {
+	s.mu.Lock()
+	if s.ids[endpoint] == sessionID {
+		delete(s.ids, endpoint)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		ids := make(map[string]string, len(s.ids))
+		for endpoint, sessionID := range s.ids {
+			ids[endpoint] = sessionID
+		}
+		s.mu.Unlock()
+
+		for endpoint, sessionID := range ids {
+			err := s.client.serverCommand(endpoint, "KEEPALIVE", sessionID)
+			if isSessionNotFound(err) {
+				log15.Error("glock client session ended by server", "endpoint", endpoint, "session", sessionID)
+				s.forget(endpoint, sessionID)
+			} else if err != nil {
+				log15.Error("glock client session keepalive error", "endpoint", endpoint, "session", sessionID, "err", err)
+			}
+		}
+	}
+}
+
+// serverCommand sends a "<cmd> <arg>" command to endpoint and checks that it didn't fail.
+func (c *Client) serverCommand(endpoint, cmd, arg string) error {
+	connection, err := c.getServerConnection(endpoint)
+	if err != nil {
+		return err
+	}
+	defer c.releaseConnection(connection)
+
+	err = connection.fprintf("%s %s\r\n", cmd, arg)
+	if err != nil {
+		return err
+	}
+	_, err = connection.readResponse()
+	return err
+}
+
+func isSessionNotFound(err error) bool {
+	internalErr, ok := err.(*internalError)
+	return ok && internalErr.Error() == "ERROR 404 session not found"
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// In cluster mode, the servers in config.Cluster keep the lock table together
+// with Raft, so that no lock is lost or handed out twice as long as most of them
+// are up. The leader grants and times out locks just like a server on its own
+// does, but every change to a holder is a Raft log entry, the records of the
+// write-ahead log, and a LOCK or EXTEND isn't answered before its entry is
+// committed. Every server applies the committed entries to a lockFSM, and a
+// server that becomes the leader holds the locks in there again, like a replica
+// that takes over.
+//
+// Timeouts run on the leader's clock. The records carry the time a lock
+// expires, which a new leader gives config.ClockDrift on top, so that no
+// lock expires early because the clocks of the old and the new leader disagree.
+// A leader that loses its majority can't commit anything anymore, so it can't
+// hand a lock to anyone else either; it steps down, dropping its lock table and
+// its client connections.
+//
+// Servers that aren't the leader answer commands with REDIRECT <address> and
+// close the connection, where address is the leader's, if they know it.
+
+// ClusterConfig turns on cluster mode.
+type ClusterConfig struct {
+	ID      string          `json:"id"`      // of this server in Servers
+	Dir     string          `json:"dir"`     // keeps the Raft log and snapshots
+	Servers []ClusterServer `json:"servers"` // all of the cluster, including this server
+}
+
+type ClusterServer struct {
+	ID      string `json:"id"`
+	Raft    string `json:"raft"`    // host:port the servers talk Raft on
+	Address string `json:"address"` // host:port clients connect to
+}
+
+// how long to wait for an entry to be committed, and for a new leader to catch up
+const clusterTimeout = 5 * time.Second
+
+// cluster is this server's node when it runs in cluster mode, and nil otherwise.
+var cluster *clusterNode
+
+type clusterNode struct {
+	raft      *raft.Raft
+	fsm       *lockFSM
+	addresses map[raft.ServerID]string // client addresses by server id
+
+	mu      sync.Mutex
+	last    raft.ApplyFuture  // of the last record proposed
+	conns   map[net.Conn]bool // client connections, dropped when stepping down
+	serving int32             // set while the node is the leader and holds the locks; atomic
+}
+
+// startCluster joins the cluster in config.Cluster.
+func startCluster() error {
+	conf := config.Cluster
+	var self *ClusterServer
+	for i := range conf.Servers {
+		if conf.Servers[i].ID == conf.ID {
+			self = &conf.Servers[i]
+		}
+	}
+	if self == nil {
+		return fmt.Errorf("server %q isn't one of the cluster's servers", conf.ID)
+	}
+
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(conf.Dir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(conf.Dir, 2, os.Stderr)
+	if err != nil {
+		return err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", self.Raft)
+	if err != nil {
+		return err
+	}
+	transport, err := raft.NewTCPTransport(self.Raft, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return err
+	}
+	node, err := newClusterNode(*conf, store, store, snapshots, transport)
+	if err != nil {
+		return err
+	}
+	if !existing {
+		// every server bootstraps the same configuration, which Raft allows
+		if err := node.bootstrap(conf.Servers); err != nil {
+			return err
+		}
+	}
+	cluster = node
+	go node.leaderLoop()
+	log15.Info("joined cluster", "id", conf.ID, "raft", self.Raft, "servers", len(conf.Servers))
+	return nil
+}
+
+func newClusterNode(conf ClusterConfig, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore, transport raft.Transport) (*clusterNode, error) {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(conf.ID)
+	raftConfig.LogLevel = config.Logging.Level
+
+	node := &clusterNode{
+		fsm:       &lockFSM{held: newHeldSet()},
+		addresses: make(map[raft.ServerID]string),
+		conns:     make(map[net.Conn]bool),
+	}
+	for _, server := range conf.Servers {
+		node.addresses[raft.ServerID(server.ID)] = server.Address
+	}
+	r, err := raft.NewRaft(raftConfig, node.fsm, logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	node.raft = r
+	return node, nil
+}
+
+func (n *clusterNode) bootstrap(servers []ClusterServer) error {
+	var configuration raft.Configuration
+	for _, server := range servers {
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(server.ID),
+			Address: raft.ServerAddress(server.Raft),
+		})
+	}
+	err := n.raft.BootstrapCluster(configuration).Error()
+	if err == raft.ErrCantBootstrap {
+		return nil
+	}
+	return err
+}
+
+// propose appends r to the Raft log, without waiting for it to be committed.
+// Entries are committed in the order they're proposed in.
+func (n *clusterNode) propose(r walRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log15.Error("error encoding log record", "key", r.Key, "err", err)
+		return
+	}
+	n.mu.Lock()
+	n.last = n.raft.Apply(b, clusterTimeout)
+	n.mu.Unlock()
+}
+
+// await waits until everything proposed so far is committed. It fails if the
+// node isn't the leader anymore.
+func (n *clusterNode) await() error {
+	n.mu.Lock()
+	last := n.last
+	n.mu.Unlock()
+	if last == nil {
+		return nil
+	}
+	return last.Error()
+}
+
+// leaderAddress returns the address clients reach the leader at, or "" if the node doesn't know it.
+func (n *clusterNode) leaderAddress() string {
+	_, id := n.raft.LeaderWithID()
+	return n.addresses[id]
+}
+
+func (n *clusterNode) isServing() bool {
+	return atomic.LoadInt32(&n.serving) == 1
+}
+
+// track adds a client connection, to be closed when the node steps down.
+func (n *clusterNode) track(conn net.Conn) {
+	n.mu.Lock()
+	n.conns[conn] = true
+	n.mu.Unlock()
+}
+
+func (n *clusterNode) untrack(conn net.Conn) {
+	n.mu.Lock()
+	delete(n.conns, conn)
+	n.mu.Unlock()
+}
+
+// leaderLoop takes over the lock table whenever the node becomes the leader,
+// and drops it when it isn't anymore.
+func (n *clusterNode) leaderLoop() {
+	for leader := range n.raft.LeaderCh() {
+		if leader {
+			n.takeOver()
+		} else {
+			n.stepDown()
+		}
+	}
+}
+
+// takeOver holds the locks in the FSM once it has caught up with everything
+// committed before, and starts serving.
+func (n *clusterNode) takeOver() {
+	for {
+		err := n.raft.Barrier(clusterTimeout).Error()
+		if err == nil {
+			break
+		}
+		log15.Error("error catching up as the new leader", "err", err)
+		if n.raft.State() != raft.Leader {
+			return
+		}
+	}
+	dropLocks()
+	drift := time.Duration(config.ClockDrift) * time.Millisecond
+	restored, expired := 0, 0
+	for _, r := range n.fsm.records() {
+		r.Expires = r.Expires.Add(drift)
+		if time.Now().Before(r.Expires) {
+			restoreHolder(r)
+			restored++
+		} else {
+			// it timed out while there was no leader
+			n.propose(walRecord{Op: walRelease, Key: r.Key, ID: r.ID})
+			expired++
+		}
+	}
+	raiseFence(n.fsm.maxFence())
+	atomic.StoreInt32(&n.serving, 1)
+	log15.Info("became the cluster leader", "locks", restored, "expired", expired)
+}
+
+// stepDown stops serving, and drops the lock table and the client connections,
+// so that clients go find the new leader.
+func (n *clusterNode) stepDown() {
+	atomic.StoreInt32(&n.serving, 0)
+	n.mu.Lock()
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.mu.Unlock()
+	dropLocks()
+	log15.Info("stepped down as the cluster leader")
+}
+
+// dropLocks empties the lock table. The locks in it are killed, without
+// recording anything, so that they don't release what a later leader holds again.
+func dropLocks() {
+	for i := range locks {
+		shard := &locks[i]
+		shard.mu.Lock()
+		for _, lock := range shard.locks {
+			lock.mu.Lock()
+			for _, h := range lock.holders {
+				if h.expiry != nil {
+					h.expiry.cancel()
+				}
+			}
+			lock.holders = make(map[int64]*lockHolder)
+			lock.used = 0
+			lock.dead = true
+			lock.mu.Unlock()
+		}
+		shard.locks = make(map[string]*timeoutLock)
+		shard.mu.Unlock()
+	}
+}
+
+// serving reports whether this server takes lock commands: always, unless it's a
+// cluster server that isn't the leader.
+func serving() bool {
+	return cluster == nil || cluster.isServing()
+}
+
+// awaitCommit waits until the changes made so far are safe from a server
+// failing: committed in a cluster, or acknowledged by the replicas otherwise.
+func awaitCommit() error {
+	if cluster != nil {
+		return cluster.await()
+	}
+	awaitReplicas()
+	return nil
+}
+
+// redirect tells a client where the leader is, if this server knows.
+func redirect(conn net.Conn) {
+	if address := cluster.leaderAddress(); address != "" {
+		fmt.Fprintf(conn, "REDIRECT %s\r\n", address)
+		return
+	}
+	conn.Write(redirectResponse)
+}
+
+// lockFSM is the Raft state machine: the holders that the committed records leave.
+type lockFSM struct {
+	mu   sync.Mutex
+	held *heldSet
+}
+
+var errBadEntry = errors.New("bad raft log entry")
+
+func (f *lockFSM) Apply(entry *raft.Log) interface{} {
+	var r walRecord
+	if err := json.Unmarshal(entry.Data, &r); err != nil {
+		log15.Error("error decoding raft log entry", "index", entry.Index, "err", err)
+		return errBadEntry
+	}
+	f.mu.Lock()
+	f.held.apply(r)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *lockFSM) records() []walRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.held.records()
+}
+
+func (f *lockFSM) maxFence() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.held.maxFence
+}
+
+func (f *lockFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &lockFSMSnapshot{Holds: f.held.records(), Fence: f.held.maxFence}, nil
+}
+
+func (f *lockFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap lockFSMSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	held := newHeldSet()
+	for _, r := range snap.Holds {
+		held.apply(r)
+	}
+	if snap.Fence > held.maxFence {
+		held.maxFence = snap.Fence
+	}
+	f.mu.Lock()
+	f.held = held
+	f.mu.Unlock()
+	return nil
+}
+
+type lockFSMSnapshot struct {
+	Holds []walRecord `json:"holds"`
+	Fence int64       `json:"fence"` // the largest fencing token handed out, even if its lock is gone
+}
+
+func (s *lockFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *lockFSMSnapshot) Release() {}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// expiryScheduler times out locks. Instead of a timer per lock, it keeps the
+// expiries in a min-heap and runs a single timer for the earliest one. Each
+// shard of the lock table has its own.
+type expiryScheduler struct {
+	mu    sync.Mutex
+	heap  expiryHeap
+	timer *time.Timer
+}
+
+// expiry is a scheduled timeout of lock id.
+type expiry struct {
+	scheduler *expiryScheduler
+	at        time.Time // changes with the lock's mutex held as well, so holders may read it
+	key       string
+	lock      *timeoutLock
+	id        int64
+	index     int // in the heap, or -1 once it's no longer scheduled
+}
+
+// schedule expires lock id once timeout has passed, unless the expiry is canceled first.
+func (s *expiryScheduler) schedule(key string, lock *timeoutLock, id int64, timeout time.Duration) *expiry {
+	e := &expiry{scheduler: s, at: time.Now().Add(timeout), key: key, lock: lock, id: id}
+	s.mu.Lock()
+	heap.Push(&s.heap, e)
+	if e.index == 0 {
+		s.wakeAt(e.at)
+	}
+	s.mu.Unlock()
+	return e
+}
+
+// cancel unschedules the expiry. It reports false if it already fired.
+func (e *expiry) cancel() bool {
+	s := e.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.index < 0 {
+		return false
+	}
+	heap.Remove(&s.heap, e.index)
+	e.index = -1
+	return true
+}
+
+// reset moves the expiry to timeout from now. It reports false if it already
+// fired, or is due and only waiting for the timer.
+func (e *expiry) reset(timeout time.Duration) bool {
+	s := e.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e.index < 0 || !e.at.After(now) {
+		return false
+	}
+	e.at = now.Add(timeout)
+	heap.Fix(&s.heap, e.index)
+	if e.index == 0 {
+		s.wakeAt(e.at)
+	}
+	return true
+}
+
+// wakeAt makes the timer fire at at. s.mu must be held.
+func (s *expiryScheduler) wakeAt(at time.Time) {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(time.Until(at), s.run)
+		return
+	}
+	s.timer.Stop()
+	s.timer.Reset(time.Until(at))
+}
+
+// run expires everything that is due and sets the timer for what's left.
+func (s *expiryScheduler) run() {
+	now := time.Now()
+	var due []*expiry
+	s.mu.Lock()
+	for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+		due = append(due, heap.Pop(&s.heap).(*expiry))
+	}
+	if len(s.heap) > 0 {
+		s.timer.Reset(time.Until(s.heap[0].at))
+	}
+	s.mu.Unlock()
+
+	// outside of s.mu, since expiring takes the lock's mutex, which is held while scheduling
+	for _, e := range due {
+		if e.lock.expire(e.id, e) {
+			log15.Debug("lock timed out", "key", e.key, "id", e.id)
+		}
+	}
+}
+
+// expiryHeap implements heap.Interface, earliest expiry first.
+type expiryHeap []*expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Every lock comes with a fencing token that is larger than any token handed out
+// before it for the same key, by this server or, as long as the servers' clocks
+// agree to well within a lock's timeout, by the server that owned the key before
+// a failover. Tokens are the time in microseconds, bumped as needed so that they
+// never repeat, and never go below the floor stored in config.FenceFile, so that
+// a clock that went backwards across a restart can't reissue an old token.
+
+// how far ahead of the last token the stored floor is kept, so that the file only
+// needs to be written every so often
+const fenceReserve = int64(10 * time.Second / time.Microsecond)
+
+var fence struct {
+	mu       sync.Mutex
+	last     int64 // the last token handed out
+	reserved int64 // the floor stored in config.FenceFile
+}
+
+// loadFence picks up where the tokens left off before the server restarted.
+func loadFence() error {
+	if config.FenceFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(config.FenceFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	floor, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return err
+	}
+	fence.mu.Lock()
+	fence.last = floor
+	fence.reserved = floor
+	fence.mu.Unlock()
+	log15.Info("loaded fencing token floor", "floor", floor)
+	return nil
+}
+
+// raiseFence makes sure that the tokens handed out from now on are larger than token.
+func raiseFence(token int64) {
+	fence.mu.Lock()
+	if token > fence.last {
+		fence.last = token
+	}
+	fence.mu.Unlock()
+}
+
+// nextFence returns a new fencing token, larger than every one before it.
+func nextFence() int64 {
+	fence.mu.Lock()
+	defer fence.mu.Unlock()
+	token := time.Now().UnixNano() / int64(time.Microsecond)
+	if token <= fence.last {
+		token = fence.last + 1
+	}
+	fence.last = token
+	if config.FenceFile != "" && token > fence.reserved {
+		reserved := token + fenceReserve
+		if err := storeFence(reserved); err != nil {
+			// the token is still good unless the clock goes backwards before the next restart
+			log15.Error("error storing fencing token floor", "file", config.FenceFile, "err", err)
+		} else {
+			fence.reserved = reserved
+		}
+	}
+	return token
+}
+
+// storeFence durably replaces the floor in config.FenceFile.
+func storeFence(floor int64) error {
+	tmp := config.FenceFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatInt(floor, 10) + "\n"); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, config.FenceFile)
+}
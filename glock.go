@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -15,8 +16,6 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/iron-io/common"
@@ -24,20 +23,27 @@ import (
 )
 
 type GlockConfig struct {
-	Port           int               `json:"port"`
-	LockLimit      int64             `json:"lock_limit"`
-	Authentication map[string]string `json:"authentication"`
-	Logging        common.LoggingConfig
+	Port             int               `json:"port"`
+	LockLimit        int64             `json:"lock_limit"`
+	PriorityAging    int64             `json:"priority_aging"`    // ms of waiting that count as much as one priority level
+	FenceFile        string            `json:"fence_file"`        // keeps fencing tokens increasing across restarts, see nextFence
+	SweepInterval    int64             `json:"sweep_interval"`    // ms between removing locks nobody uses, see sweepLocks
+	DataDir          string            `json:"data_dir"`          // keeps held locks across restarts, see restoreLocks
+	SnapshotInterval int64             `json:"snapshot_interval"` // ms between snapshots of the held locks in DataDir
+	ReplicaOf        string            `json:"replica_of"`        // host:port of the primary to replicate, see followPrimary
+	ReplicaUsername  string            `json:"replica_username"`  // to authenticate with the primary
+	ReplicaPassword  string            `json:"replica_password"`
+	ReplicaUsers     []string          `json:"replica_users"`    // the users replicas of this server authenticate as, see serveReplica
+	Successors       []string          `json:"successors"`       // host:port of the replicas of ReplicaOf that take over before this one
+	FailoverTimeout  int64             `json:"failover_timeout"` // ms a replica waits for a gone primary before taking over
+	ClockDrift       int64             `json:"clock_drift"`      // ms the clocks of a server and the one taking over from it may be apart
+	Cluster          *ClusterConfig    `json:"cluster"`          // runs the server in a Raft cluster, see startCluster
+	Ring             []string          `json:"ring"`             // endpoints of the servers that share the keys, see loadRing
+	Endpoint         string            `json:"endpoint"`         // this server's endpoint in Ring
+	Authentication   map[string]string `json:"authentication"`
+	Logging          common.LoggingConfig
 }
 
-type timeoutLock struct {
-	mutex     sync.Mutex
-	id        int64 // unique ID of the current lock. Only allow an unlock if the correct id is passed
-	lockCount int64
-}
-
-var locksLock sync.RWMutex
-var locks = map[string]*timeoutLock{}
 var config GlockConfig
 
 func main() {
@@ -59,13 +65,28 @@ func main() {
 		config.Port = port
 	}
 
-	if config.Logging.Level == "" {
-		config.Logging.Level = "info"
+	if config.PriorityAging == 0 {
+		config.PriorityAging = 1000
 	}
 
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
-	if err != nil {
-		log.Fatalln("error listening", err)
+	if config.SweepInterval == 0 {
+		config.SweepInterval = 60000
+	}
+
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = 60000
+	}
+
+	if config.FailoverTimeout == 0 {
+		config.FailoverTimeout = 5000
+	}
+
+	if config.ClockDrift == 0 {
+		config.ClockDrift = 1000
+	}
+
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
 	}
 
 	if logLocal {
@@ -74,6 +95,49 @@ func main() {
 	}
 	common.SetLogging(config.Logging)
 
+	if err := loadFence(); err != nil {
+		log.Fatalln("error loading fencing token floor", err)
+	}
+
+	if err := loadRing(); err != nil {
+		log.Fatalln("error loading ring", err)
+	}
+
+	if config.Cluster != nil {
+		if err := startCluster(); err != nil {
+			log.Fatalln("error starting cluster", err)
+		}
+	} else if config.ReplicaOf != "" {
+		// a replica only starts listening once it takes over
+		held := followPrimary()
+		if config.DataDir != "" {
+			// before the locks are held again, since they may time out right away
+			if err := startLogging(); err != nil {
+				log.Fatalln("error starting write-ahead log", err)
+			}
+		}
+		log15.Info("took over from primary", "primary", config.ReplicaOf, "locks", held.restore(time.Duration(config.ClockDrift)*time.Millisecond), "fence", held.maxFence)
+		if config.DataDir != "" {
+			if err := takeSnapshot(); err != nil {
+				log.Fatalln("error taking snapshot", err)
+			}
+		}
+	} else if config.DataDir != "" {
+		if err := restoreLocks(); err != nil {
+			log.Fatalln("error restoring locks", err)
+		}
+	}
+	if config.DataDir != "" {
+		go snapshotLocks(time.Duration(config.SnapshotInterval) * time.Millisecond)
+	}
+
+	go sweepLocks(time.Duration(config.SweepInterval) * time.Millisecond)
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
+	if err != nil {
+		log.Fatalln("error listening", err)
+	}
+
 	log15.Info("glock server available", "port", config.Port)
 
 	for {
@@ -87,18 +151,109 @@ func main() {
 }
 
 var (
+	notLockedResponse   = []byte("NOT_LOCKED\r\n")
+	canceledResponse    = []byte("CANCELED\r\n")
+	notCanceledResponse = []byte("NOT_CANCELED\r\n")
 	unlockedResponse    = []byte("UNLOCKED\r\n")
 	notUnlockedResponse = []byte("NOT_UNLOCKED\r\n")
+	releasedResponse    = []byte("RELEASED\r\n")
+	notReleasedResponse = []byte("NOT_RELEASED\r\n")
+	extendedResponse    = []byte("EXTENDED\r\n")
+	notExtendedResponse = []byte("NOT_EXTENDED\r\n")
 	pongResponse        = []byte("PONG\r\n")
+	leaderResponse      = []byte("LEADER\r\n")
+	redirectResponse    = []byte("REDIRECT\r\n")
 	authorizedResponse  = []byte("AUTHORIZED\r\n")
 
-	errBadFormat      = []byte("ERROR 400 bad command format\r\n")
-	errUnauthorized   = []byte("ERROR 403 unauthorized\n")
-	errLockNotFound   = []byte("ERROR 404 lock not found\r\n")
-	errUnknownCommand = []byte("ERROR 405 unknown command\r\n")
-	errLockAtCapacity = []byte("ERROR 503 lock at capacity\r\n")
+	errBadFormat       = []byte("ERROR 400 bad command format\r\n")
+	errUnauthorized    = []byte("ERROR 403 unauthorized\n")
+	errNotLockOwner    = []byte("ERROR 403 lock held by another user\r\n")
+	errSessionNotFound = []byte("ERROR 404 session not found\r\n")
+	errUnknownCommand  = []byte("ERROR 405 unknown command\r\n")
+	errLockWaitTimeout = []byte("ERROR 408 lock wait timeout\r\n")
+	errInternal        = []byte("ERROR 500 internal error\r\n")
+	errLockAtCapacity  = []byte("ERROR 503 lock at capacity\r\n")
 )
 
+var (
+	errAtCapacity  = errors.New("lock at capacity")
+	errWaitTimeout = errors.New("lock wait timeout")
+	errCanceled    = errors.New("lock wait canceled")
+	errNotHeld     = errors.New("lock not held")
+	errNotOwner    = errors.New("lock held by another user")
+	errLockHeld    = errors.New("lock held")
+	errLockRemoved = errors.New("lock removed by the sweeper") // get the lock with getLock again
+	errMaxMismatch = errors.New("semaphore max differs from its holders'")
+)
+
+// lockOptions holds the optional name=value arguments that can follow a LOCK's timeout.
+type lockOptions struct {
+	wait     time.Duration // how long to wait to acquire the lock; negative waits forever
+	priority int           // higher priorities are handed the lock first
+	session  string        // session the lock is released with; "conn" ties it to the connection
+	queued   bool          // report the position in the queue with QUEUED lines while waiting
+	owner    string        // a LOCK by the lock's owner takes it again instead of waiting
+}
+
+// priorities beyond this are rejected, so that priority times aging can't overflow
+const maxPriority = 1000000
+
+func parseLockOptions(args []string) (lockOptions, error) {
+	opts := lockOptions{wait: -1}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return opts, fmt.Errorf("bad lock option %q", arg)
+		}
+		switch kv[0] {
+		case "wait":
+			wait, err := strconv.Atoi(kv[1])
+			if err != nil || wait < 0 {
+				return opts, fmt.Errorf("bad lock wait %q", kv[1])
+			}
+			opts.wait = time.Duration(wait) * time.Millisecond
+		case "priority":
+			priority, err := strconv.Atoi(kv[1])
+			if err != nil || priority > maxPriority || priority < -maxPriority {
+				return opts, fmt.Errorf("bad lock priority %q", kv[1])
+			}
+			opts.priority = priority
+		case "session":
+			opts.session = kv[1]
+		case "queued":
+			queued, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return opts, fmt.Errorf("bad lock queued %q", kv[1])
+			}
+			opts.queued = queued
+		case "owner":
+			opts.owner = kv[1]
+		default:
+			return opts, fmt.Errorf("unknown lock option %q", kv[0])
+		}
+	}
+	return opts, nil
+}
+
+// parseSemaphoreRequest parses the <permits> <max> that start an ACQUIRE's
+// arguments and returns the rest, starting with the timeout.
+func parseSemaphoreRequest(args []string) (lockRequest, []string, error) {
+	req := lockRequest{mode: semaphore}
+	if len(args) < 3 {
+		return req, nil, errors.New("missing semaphore arguments")
+	}
+	var err error
+	if req.permits, err = strconv.Atoi(args[0]); err != nil || req.permits <= 0 {
+		return req, nil, fmt.Errorf("bad semaphore permits %q", args[0])
+	}
+	if req.max, err = strconv.Atoi(args[1]); err != nil || req.max < req.permits {
+		return req, nil, fmt.Errorf("bad semaphore max %q", args[1])
+	}
+	return req, args[2:], nil
+}
+
+// authConn authenticates the client, if the server requires it, and goes on to
+// serve its commands.
 func authConn(conn net.Conn) {
 	if len(config.Authentication) != 0 {
 		authKey, err := randByte(24)
@@ -145,7 +300,8 @@ func authConn(conn net.Conn) {
 				if CheckMAC([]byte(password), expectedMAC, authKey) {
 					log15.Debug("authorized", "cmd", split)
 					conn.Write(authorizedResponse)
-					break
+					handleConn(conn, username)
+					return
 				}
 				fallthrough
 			default:
@@ -155,12 +311,18 @@ func authConn(conn net.Conn) {
 			}
 
 		}
+		// the connection closed before authenticating
+		conn.Close()
+		return
 	}
 
-	handleConn(conn)
+	handleConn(conn, "")
 }
 
-func handleConn(conn net.Conn) {
+// handleConn serves the commands of a client that authenticated as user, which
+// is empty if the server doesn't require authentication. Locks can only be
+// unlocked or extended by the user who took them.
+func handleConn(conn net.Conn, user string) {
 	defer func() {
 		conn.Close()
 		// make sure a panic doesn't take down the whole server
@@ -170,15 +332,90 @@ func handleConn(conn net.Conn) {
 		}
 	}()
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		split := strings.Fields(scanner.Text())
+	if cluster != nil {
+		cluster.track(conn)
+		defer cluster.untrack(conn)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	commands := newCommandReader(conn, done)
+
+	// locks taken with session=conn go away with the connection
+	var connSession *session
+	defer func() {
+		if connSession != nil {
+			connSession.end()
+		}
+	}()
+	// sessionFor returns the session named by a session= option, or nil for none
+	sessionFor := func(name string) (*session, bool) {
+		switch name {
+		case "":
+			return nil, true
+		case "conn":
+			if connSession == nil {
+				connSession = &session{user: user}
+			}
+			return connSession, true
+		}
+		return getSession(name)
+	}
+
+	for {
+		split, ok := commands.next()
+		if !ok {
+			return
+		}
 
 		if split[0] == "PING" {
 			conn.Write(pongResponse)
 			continue
 		}
 
+		// CANCEL only means something while a LOCK is waiting; see commandReader.watchCancel
+		if split[0] == "CANCEL" {
+			conn.Write(notCanceledResponse)
+			continue
+		}
+
+		// LEADER responds with LEADER if this server takes lock commands, and
+		// everything but STATS and TOPOLOGY is redirected to the leader otherwise
+		if !serving() && split[0] != "STATS" && split[0] != "TOPOLOGY" {
+			redirect(conn)
+			return
+		}
+		if split[0] == "LEADER" {
+			conn.Write(leaderResponse)
+			continue
+		}
+
+		switch split[0] {
+		case "SESSION", "KEEPALIVE", "ENDSESSION":
+			handleSessionCommand(conn, split, user)
+			continue
+
+		// STATS responds with STATS locks=<number of keys with a lock in memory> replicas=<number of replicas>
+		case "STATS":
+			fmt.Fprintf(conn, "STATS locks=%d replicas=%d\r\n", liveLocks(), replicaCount())
+			continue
+
+		// REPLICATE turns the connection into a stream of lock changes, see serveReplica
+		case "REPLICATE":
+			if !replicaUser(user) {
+				conn.Write(errUnauthorized)
+				log15.Error("unauthorized", "cmd", split, "user", user)
+				continue
+			}
+			serveReplica(conn, commands)
+			return
+
+		// TOPOLOGY responds with TOPOLOGY <endpoint>..., the ring's endpoints, if the server knows the ring
+		case "TOPOLOGY":
+			conn.Write([]byte(topology()))
+			continue
+		}
+
 		if len(split) < 3 {
 			conn.Write(errBadFormat)
 			continue
@@ -187,46 +424,220 @@ func handleConn(conn net.Conn) {
 		cmd := split[0]
 		key := split[1]
 		switch cmd {
-		// LOCK <key> <timeout>
-		case "LOCK":
-			timeout, err := strconv.Atoi(split[2])
-
+		// LOCK <key> <timeout> [wait=<ms>] [priority=<n>] [session=<session>|conn] [queued=1] [owner=<owner>]
+		// TRYLOCK <key> <timeout> [session=<session>|conn] [owner=<owner>]
+		// RLOCK <key> <timeout> [same options as LOCK]
+		// ACQUIRE <key> <permits> <max> <timeout> [same options as LOCK]
+		//
+		// respond with LOCKED <id> <fence>, or ACQUIRED <id> <fence>. The id is
+		// a random token for unlocking, the fence a fencing token, see nextFence.
+		// A key another server owns is answered with MOVED <endpoint>, see loadRing.
+		case "LOCK", "TRYLOCK", "RLOCK", "ACQUIRE":
+			if moved(conn, key) {
+				log15.Debug("moved", "cmd", split, "key", key)
+				continue
+			}
+			req := lockRequest{mode: exclusive}
+			args := split[2:]
+			lockedFormat := "LOCKED %v %v\n"
+			if cmd == "RLOCK" {
+				req.mode = shared
+			}
+			if cmd == "ACQUIRE" {
+				var err error
+				if req, args, err = parseSemaphoreRequest(args); err != nil {
+					conn.Write(errBadFormat)
+					log15.Error("bad command format", "cmd", split, "err", err)
+					continue
+				}
+				lockedFormat = "ACQUIRED %v %v\r\n"
+			}
+			timeout, err := strconv.Atoi(args[0])
 			if err != nil {
 				conn.Write(errBadFormat)
 				log15.Error("bad command format", "cmd", split)
 				continue
 			}
-			locksLock.RLock()
-			lock, ok := locks[key]
-			locksLock.RUnlock()
+			opts, err := parseLockOptions(args[1:])
+			if err != nil {
+				conn.Write(errBadFormat)
+				log15.Error("bad command format", "cmd", split, "err", err)
+				continue
+			}
+			req.owner = opts.owner
+			req.user = user
+			sess, ok := sessionFor(opts.session)
 			if !ok {
-				// lock doesn't exist; create it
-				locksLock.Lock()
-				lock, ok = locks[key]
-				if !ok {
-					lock = &timeoutLock{}
-					locks[key] = lock
+				conn.Write(errSessionNotFound)
+				log15.Debug("session not found", "cmd", split, "session", opts.session)
+				continue
+			}
+			if sess != nil && sess.user != user {
+				conn.Write(errNotLockOwner)
+				log15.Info("lock in another user's session rejected", "cmd", split, "user", user)
+				continue
+			}
+
+			// set when a CANCEL raced with getting the lock. The client then
+			// expects both responses and will unlock the lock itself.
+			var canceled bool
+			var lock *timeoutLock
+			var id, fence int64
+			if cmd == "TRYLOCK" {
+				for err = errLockRemoved; err == errLockRemoved; {
+					lock = getLock(key)
+					id, fence, err = lock.tryAcquire(req)
+				}
+				if err != nil {
+					conn.Write(notLockedResponse)
+					log15.Debug("not locked", "cmd", split, "key", key)
+					continue
+				}
+			} else {
+				var queued func(position int)
+				if opts.queued {
+					queued = func(position int) {
+						fmt.Fprintf(conn, "QUEUED %d\r\n", position)
+					}
+				}
+				cancel, stopWatching := commands.watchCancel()
+				for err = errLockRemoved; err == errLockRemoved; {
+					lock = getLock(key)
+					id, fence, err = lock.acquire(req, opts, cancel, queued)
+				}
+				canceled = stopWatching()
+				if commands.closed {
+					// the client is gone, so don't hold the lock for nobody
+					if err == nil {
+						lock.release(id)
+					}
+					log15.Debug("lock wait abandoned by closed connection", "cmd", split, "key", key)
+					return
+				}
+				if err != nil {
+					writeLockWaitError(conn, split, err, canceled)
+					continue
 				}
-				locksLock.Unlock()
+			}
+			lock.expireAfter(id, time.Duration(timeout)*time.Millisecond)
+			if err := awaitCommit(); err != nil {
+				// the leader stepped down
+				lock.release(id)
+				redirect(conn)
+				return
+			}
+			if sess != nil && !sess.add(key, lock, id) {
+				// the session ended while we waited
+				lock.release(id)
+				conn.Write(errSessionNotFound)
+			} else if _, err := fmt.Fprintf(conn, lockedFormat, id, fence); err != nil {
+				// nobody will ever know they hold it
+				lock.release(id)
+				log15.Debug("released undeliverable lock", "cmd", split, "key", key, "id", id, "err", err)
+				return
+			}
+			if canceled {
+				conn.Write(notCanceledResponse)
 			}
 
-			if !lock.lockMutex() {
-				conn.Write(errLockAtCapacity)
+			log15.Debug("locked", "cmd", split, "timeout", timeout, "key", key, "id", id, "fence", fence)
+
+		// MLOCK <timeout> <count> <key>... [wait=<ms>] [priority=<n>] [session=<session>|conn]
+		//
+		// responds with LOCKED <id> <fence> <id> <fence>..., one pair per key, or
+		// MOVED <endpoint> for the first key another server owns
+		case "MLOCK":
+			timeout, keys, opts, err := parseMultiLock(split)
+			if err != nil {
+				conn.Write(errBadFormat)
+				log15.Error("bad command format", "cmd", split, "err", err)
 				continue
 			}
-			id := atomic.AddInt64(&lock.id, 1)
-			time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
-				if atomic.CompareAndSwapInt64(&lock.id, id, id+1) {
-					lock.unlockMutex()
-					log15.Debug("lock timed out", "timeout", timeout, "key", key, "id", id)
+			misplaced := false
+			for _, key := range keys {
+				if misplaced = moved(conn, key); misplaced {
+					break
 				}
-			})
-			fmt.Fprintf(conn, "LOCKED %v\n", id)
+			}
+			if misplaced {
+				log15.Debug("moved", "cmd", split)
+				continue
+			}
+			sess, ok := sessionFor(opts.session)
+			if !ok {
+				conn.Write(errSessionNotFound)
+				log15.Debug("session not found", "cmd", split, "session", opts.session)
+				continue
+			}
+			if sess != nil && sess.user != user {
+				conn.Write(errNotLockOwner)
+				log15.Info("lock in another user's session rejected", "cmd", split, "user", user)
+				continue
+			}
 
-			log15.Debug("locked", "cmd", split, "timeout", timeout, "key", key, "id", id)
+			cancel, stopWatching := commands.watchCancel()
+			ids, fences, err := acquireMulti(keys, user, opts, cancel)
+			canceled := stopWatching()
+			releaseAll := func() {
+				for i, key := range keys {
+					getLock(key).release(ids[i])
+				}
+			}
+			if commands.closed {
+				if err == nil {
+					releaseAll()
+				}
+				log15.Debug("lock wait abandoned by closed connection", "cmd", split)
+				return
+			}
+			if err != nil {
+				writeLockWaitError(conn, split, err, canceled)
+				continue
+			}
+
+			added := true
+			for i, key := range keys {
+				lock := getLock(key)
+				lock.expireAfter(ids[i], time.Duration(timeout)*time.Millisecond)
+				if sess != nil && !sess.add(key, lock, ids[i]) {
+					added = false
+				}
+			}
+			if err := awaitCommit(); err != nil {
+				for i, key := range keys {
+					getLock(key).release(ids[i])
+				}
+				redirect(conn)
+				return
+			}
+			response := "LOCKED"
+			for i, id := range ids {
+				response += " " + strconv.FormatInt(id, 10) + " " + strconv.FormatInt(fences[i], 10)
+			}
+			if !added {
+				releaseAll()
+				conn.Write(errSessionNotFound)
+			} else if _, err := fmt.Fprintf(conn, "%s\r\n", response); err != nil {
+				releaseAll()
+				log15.Debug("released undeliverable locks", "cmd", split, "ids", ids, "err", err)
+				return
+			}
+			if canceled {
+				conn.Write(notCanceledResponse)
+			}
+
+			log15.Debug("locked", "cmd", split, "timeout", timeout, "ids", ids, "fences", fences)
 
 		// UNLOCK <key> <id>
-		case "UNLOCK":
+		// RUNLOCK <key> <id>
+		// RELEASE <key> <id>
+		//
+		// a key another server owns is answered with MOVED <endpoint>, as for LOCK
+		case "UNLOCK", "RUNLOCK", "RELEASE":
+			if moved(conn, key) {
+				log15.Debug("moved", "cmd", split, "key", key)
+				continue
+			}
 			id, err := strconv.ParseInt(split[2], 10, 64)
 
 			if err != nil {
@@ -234,23 +645,80 @@ func handleConn(conn net.Conn) {
 				log15.Error("bad command format", "cmd", split)
 				continue
 			}
-			locksLock.RLock()
-			lock, ok := locks[key]
-			locksLock.RUnlock()
+			mode, released, notReleased := exclusive, unlockedResponse, notUnlockedResponse
+			switch cmd {
+			case "RUNLOCK":
+				mode = shared
+			case "RELEASE":
+				mode, released, notReleased = semaphore, releasedResponse, notReleasedResponse
+			}
+			lock, ok := findLock(key)
 			if !ok {
-				conn.Write(errLockNotFound)
-				log15.Error("lock not found", "cmd", split, "key", key, "id", id)
+				// nobody holds it; it was probably swept after timing out
+				conn.Write(notReleased)
+				log15.Debug("not unlocked", "cmd", split, "key", key, "id", id)
 				continue
 			}
-			if atomic.CompareAndSwapInt64(&lock.id, id, id+1) {
-				lock.unlockMutex()
-				conn.Write(unlockedResponse)
+			switch lock.releaseBy(id, user, mode) {
+			case nil:
+				conn.Write(released)
 				log15.Debug("unlocked", "cmd", split, "key", key, "id", id)
-			} else {
-				conn.Write(notUnlockedResponse)
+			case errNotOwner:
+				conn.Write(errNotLockOwner)
+				log15.Info("unlock by another user rejected", "cmd", split, "key", key, "user", user)
+			default:
+				conn.Write(notReleased)
 				log15.Debug("not unlocked", "cmd", split, "key", key, "id", id)
 			}
 
+		// EXTEND <key> <id> <timeout>
+		//
+		// a key another server owns is answered with MOVED <endpoint>, as for LOCK
+		case "EXTEND":
+			if moved(conn, key) {
+				log15.Debug("moved", "cmd", split, "key", key)
+				continue
+			}
+			if len(split) < 4 {
+				conn.Write(errBadFormat)
+				log15.Error("bad command format", "cmd", split)
+				continue
+			}
+			id, err := strconv.ParseInt(split[2], 10, 64)
+			if err != nil {
+				conn.Write(errBadFormat)
+				log15.Error("bad command format", "cmd", split)
+				continue
+			}
+			timeout, err := strconv.Atoi(split[3])
+			if err != nil {
+				conn.Write(errBadFormat)
+				log15.Error("bad command format", "cmd", split)
+				continue
+			}
+			lock, ok := findLock(key)
+			if !ok {
+				// nobody holds it; it was probably swept after timing out
+				conn.Write(notExtendedResponse)
+				log15.Debug("not extended", "cmd", split, "key", key, "id", id)
+				continue
+			}
+			switch lock.extend(id, user, time.Duration(timeout)*time.Millisecond) {
+			case nil:
+				if err := awaitCommit(); err != nil {
+					redirect(conn)
+					return
+				}
+				conn.Write(extendedResponse)
+				log15.Debug("extended", "cmd", split, "key", key, "id", id, "timeout", timeout)
+			case errNotOwner:
+				conn.Write(errNotLockOwner)
+				log15.Info("extend by another user rejected", "cmd", split, "key", key, "user", user)
+			default:
+				conn.Write(notExtendedResponse)
+				log15.Debug("not extended", "cmd", split, "key", key, "id", id)
+			}
+
 		default:
 			conn.Write(errUnknownCommand)
 			log15.Error(string(errUnknownCommand), ": ", split)
@@ -259,41 +727,126 @@ func handleConn(conn net.Conn) {
 	}
 }
 
-func LoadConfig(configFile string, config interface{}) {
-	config_s, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalln("Couldn't find config at:", configFile)
+// writeLockWaitError responds to a lock wait that ended without the lock. If a
+// CANCEL was consumed while it waited, but the wait ended for another reason,
+// the CANCEL is answered too, since the client waits for that.
+func writeLockWaitError(conn net.Conn, split []string, err error, canceled bool) {
+	if canceled && err != errCanceled {
+		defer conn.Write(notCanceledResponse)
 	}
-
-	err = json.Unmarshal(config_s, &config)
-	if err != nil {
-		log.Fatalln("Couldn't unmarshal config!", err)
+	switch err {
+	case errCanceled:
+		conn.Write(canceledResponse)
+		log15.Debug("lock wait canceled", "cmd", split)
+	case errWaitTimeout:
+		conn.Write(errLockWaitTimeout)
+		log15.Debug("lock wait timed out", "cmd", split)
+	case errMaxMismatch:
+		conn.Write(errBadFormat)
+		log15.Error("bad command format", "cmd", split, "err", err)
+	default:
+		conn.Write(errLockAtCapacity)
 	}
-	log15.Info("loaded config", "config", config)
 }
 
-func (l *timeoutLock) lockMutex() bool {
-	if config.LockLimit != 0 {
-		for {
-			count := atomic.LoadInt64(&l.lockCount)
-			if count >= config.LockLimit {
-				return false
+// commandReader reads commands off a connection in the background, so that a
+// LOCK that is waiting for its lock can still see a CANCEL from the client.
+type commandReader struct {
+	lines   chan []string
+	done    <-chan struct{}
+	pending [][]string // commands that arrived while a LOCK was waiting
+	closed  bool
+}
+
+func newCommandReader(conn net.Conn, done <-chan struct{}) *commandReader {
+	r := &commandReader{lines: make(chan []string), done: done}
+	go func() {
+		defer close(r.lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			select {
+			case r.lines <- strings.Fields(scanner.Text()):
+			case <-done:
+				return
 			}
+		}
+	}()
+	return r
+}
+
+// next returns the next command, or false once the connection is closed.
+func (r *commandReader) next() ([]string, bool) {
+	if len(r.pending) > 0 {
+		split := r.pending[0]
+		r.pending = r.pending[1:]
+		return split, true
+	}
+	if r.closed {
+		return nil, false
+	}
+	split, ok := <-r.lines
+	if !ok {
+		r.closed = true
+	}
+	return split, ok
+}
 
-			if atomic.CompareAndSwapInt64(&l.lockCount, count, count+1) {
-				break
+// watchCancel watches for a CANCEL while a LOCK waits. The returned channel is
+// closed when one arrives or the connection closes; any other commands are kept
+// for next. stop must be called before next is used again, and reports whether
+// a CANCEL was consumed.
+func (r *commandReader) watchCancel() (cancel <-chan struct{}, stop func() bool) {
+	canceled := make(chan struct{})
+	if r.closed {
+		close(canceled)
+		return canceled, func() bool { return false }
+	}
+
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	sawCancel := false
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case split, ok := <-r.lines:
+				if !ok {
+					// nobody is waiting for the lock anymore
+					r.closed = true
+					close(canceled)
+					return
+				}
+				if len(split) > 0 && split[0] == "CANCEL" {
+					sawCancel = true
+					close(canceled)
+					return
+				}
+				r.pending = append(r.pending, split)
+			case <-stopping:
+				return
+			case <-r.done:
+				return
 			}
 		}
+	}()
+	return canceled, func() bool {
+		close(stopping)
+		<-stopped
+		return sawCancel
 	}
-	l.mutex.Lock()
-	return true
 }
 
-func (l *timeoutLock) unlockMutex() {
-	l.mutex.Unlock()
-	if config.LockLimit != 0 {
-		atomic.AddInt64(&l.lockCount, -1)
+func LoadConfig(configFile string, config interface{}) {
+	config_s, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Fatalln("Couldn't find config at:", configFile)
+	}
+
+	err = json.Unmarshal(config_s, &config)
+	if err != nil {
+		log.Fatalln("Couldn't unmarshal config!", err)
 	}
+	log15.Info("loaded config", "config", config)
 }
 
 func randByte(n int) ([]byte, error) {
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/iron-io/common"
+)
+
+func TestMain(m *testing.M) {
+	common.SetLogging(common.LoggingConfig{Level: "error"})
+	os.Exit(m.Run())
+}
+
+// TestRestoreLocks restarts the lock table from its data dir, with some changes
+// in the snapshot and some only in the log after it.
+func TestRestoreLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.DataDir = dir
+	defer func() { config.DataDir = "" }()
+	defer resetLocks()
+	if err := restoreLocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := func(key string, req lockRequest) (id, fence int64) {
+		l := getLock(key)
+		id, fence, err := l.acquire(req, lockOptions{wait: -1}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.expireAfter(id, time.Minute)
+		return id, fence
+	}
+	snapshotted, snapshottedFence := lock("restore-snapshotted", lockRequest{mode: exclusive, owner: "worker", user: "test"})
+	lock("restore-snapshotted", lockRequest{mode: exclusive, owner: "worker", user: "test"})
+	released, _ := lock("restore-released", lockRequest{mode: shared})
+	getLock("restore-released").release(released)
+	if err := takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	logged, _ := lock("restore-logged", lockRequest{mode: semaphore, permits: 2, max: 3})
+	unlogged, _ := lock("restore-unlogged", lockRequest{mode: exclusive})
+	getLock("restore-unlogged").release(unlogged)
+	getLock("restore-snapshotted").release(snapshotted)
+	lastFence := nextFence()
+
+	// start over, as if the server restarted
+	resetLocks()
+	if err := restoreLocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, ok := findLock("restore-snapshotted")
+	if !ok || !l.holds(snapshotted) {
+		t.Fatal("lock from the snapshot not restored")
+	}
+	if h := l.holders[snapshotted]; h.fence != snapshottedFence || h.owner != "worker" || h.user != "test" || h.holds != 1 {
+		t.Fatalf("restored holder %+v, wanted fence %d, owner worker, user test and 1 hold", h, snapshottedFence)
+	}
+	if l, ok := findLock("restore-logged"); !ok || !l.holds(logged) || l.used != 2 || l.mode != semaphore {
+		t.Fatal("lock from the log not restored")
+	}
+	if l, ok := findLock("restore-released"); ok && l.holds(released) {
+		t.Fatal("released lock restored")
+	}
+	if l, ok := findLock("restore-unlogged"); ok && l.holds(unlogged) {
+		t.Fatal("released lock restored")
+	}
+	if fence := nextFence(); fence <= lastFence {
+		t.Fatalf("fencing token %d after restoring, wanted more than %d", fence, lastFence)
+	}
+
+	// timeouts carry on from where they were
+	time.Sleep(10 * time.Millisecond)
+	if err := l.extend(snapshotted, "test", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if l.holds(snapshotted) {
+		t.Fatal("restored lock didn't time out")
+	}
+}
+
+// TestReplication follows the lock table over a REPLICATE connection, and takes over with it.
+func TestReplication(t *testing.T) {
+	defer resetLocks()
+	lock := func(key string) (l *timeoutLock, id, fence int64) {
+		l = getLock(key)
+		id, fence, err := l.acquire(lockRequest{mode: exclusive, user: "test"}, lockOptions{wait: -1}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.expireAfter(id, time.Minute)
+		awaitReplicas()
+		return l, id, fence
+	}
+	_, before, beforeFence := lock("replicate-before")
+
+	primary, replica := net.Pipe()
+	go handleConn(primary, "")
+	state := &replicaState{}
+	followed := make(chan error, 1)
+	go func() {
+		fmt.Fprintf(replica, "REPLICATE\r\n")
+		followed <- state.follow(replica, bufio.NewReader(replica), time.Minute)
+	}()
+	held := func() *heldSet {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		return state.held
+	}
+	holds := func(key string, id int64) (walRecord, bool) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		r, ok := state.held.holders[key][id]
+		return r, ok
+	}
+	for start := time.Now(); held() == nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("replica never synced")
+		}
+	}
+	if r, ok := holds("replicate-before", before); !ok || r.Fence != beforeFence {
+		t.Fatal("lock held before the replica connected not replicated")
+	}
+
+	_, after, afterFence := lock("replicate-after")
+	// the replica acknowledged it before lock returned
+	if r, ok := holds("replicate-after", after); !ok || r.Fence != afterFence || r.User != "test" {
+		t.Fatal("lock not replicated")
+	}
+	l, released, _ := lock("replicate-released")
+	l.release(released)
+	lock("replicate-later")
+	if _, ok := holds("replicate-released", released); ok {
+		t.Fatal("release not replicated")
+	}
+
+	replica.Close()
+	if err := <-followed; err == nil {
+		t.Fatal("expected follow to fail once the connection is gone")
+	}
+	for start := time.Now(); replicaCount() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("replica not dropped")
+		}
+	}
+
+	// take over, as if on another server
+	resetLocks()
+	held().restore(time.Second)
+	if l, ok := findLock("replicate-before"); !ok || !l.holds(before) {
+		t.Fatal("replicated lock not held after taking over")
+	}
+	if l, ok := findLock("replicate-after"); !ok || !l.holds(after) {
+		t.Fatal("replicated lock not held after taking over")
+	}
+	if l, ok := findLock("replicate-released"); ok && l.holds(released) {
+		t.Fatal("released lock held after taking over")
+	}
+	if fence := nextFence(); fence <= afterFence {
+		t.Fatalf("fencing token %d after taking over, wanted more than %d", fence, afterFence)
+	}
+}
+
+// TestSuccessors has a replica follow the successor of its gone primary, and
+// only take over once that's gone too.
+func TestSuccessors(t *testing.T) {
+	defer resetLocks()
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+	successor, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := successor.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(conn, "")
+		}
+	}()
+	config.ReplicaOf, config.Successors, config.FailoverTimeout = gone.Addr().String(), []string{successor.Addr().String()}, 200
+	defer func() { config.ReplicaOf, config.Successors, config.FailoverTimeout = "", nil, 0 }()
+
+	l := getLock("successor-lock")
+	id, _, err := l.acquire(lockRequest{mode: exclusive, user: "test"}, lockOptions{wait: -1}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.expireAfter(id, time.Minute)
+
+	tookOver := make(chan *heldSet, 1)
+	go func() { tookOver <- followPrimary() }()
+	for start := time.Now(); replicaCount() == 0; time.Sleep(time.Millisecond) {
+		select {
+		case <-tookOver:
+			t.Fatal("took over instead of following the successor")
+		default:
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("successor never replicated")
+		}
+	}
+
+	successor.Close()
+	replication.mu.Lock()
+	for rep := range replication.replicas {
+		dropReplica(rep)
+	}
+	replication.mu.Unlock()
+	select {
+	case held := <-tookOver:
+		if _, ok := held.holders["successor-lock"][id]; !ok {
+			t.Fatal("successor's lock not taken over")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("never took over from the gone successor")
+	}
+}
+
+// TestCluster runs three cluster nodes in one process, and has the lock
+// table taken over by a new leader once the first one is gone.
+func TestCluster(t *testing.T) {
+	conf := ClusterConfig{}
+	for _, id := range []string{"a", "b", "c"} {
+		conf.Servers = append(conf.Servers, ClusterServer{ID: id, Raft: id, Address: id + ":45625"})
+	}
+	config.Cluster = &conf
+	defer func() { config.Cluster, cluster = nil, nil }()
+	defer resetLocks()
+
+	transports := make([]*raft.InmemTransport, len(conf.Servers))
+	for i, server := range conf.Servers {
+		_, transports[i] = raft.NewInmemTransport(raft.ServerAddress(server.Raft))
+	}
+	var nodes []*clusterNode
+	for i, server := range conf.Servers {
+		for j, peer := range conf.Servers {
+			if i != j {
+				transports[i].Connect(raft.ServerAddress(peer.Raft), transports[j])
+			}
+		}
+		nodeConf := conf
+		nodeConf.ID = server.ID
+		store := raft.NewInmemStore()
+		node, err := newClusterNode(nodeConf, store, store, raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.raft.Shutdown()
+		if err := node.bootstrap(conf.Servers); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	leader := func() *clusterNode {
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			for _, node := range nodes {
+				if node.raft.State() == raft.Leader {
+					return node
+				}
+			}
+		}
+		t.Fatal("no leader elected")
+		return nil
+	}
+
+	cluster = leader()
+	cluster.takeOver()
+	l := getLock("cluster-lock")
+	id, fence, err := l.acquire(lockRequest{mode: exclusive, user: "test"}, lockOptions{wait: -1}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.expireAfter(id, time.Minute)
+	if err := awaitCommit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node == cluster {
+			continue
+		}
+		if err := node.raft.Barrier(time.Second).Error(); err != raft.ErrNotLeader {
+			t.Fatalf("follower barrier returned %v, wanted %v", err, raft.ErrNotLeader)
+		}
+		node.propose(walRecord{Op: walRelease, Key: "cluster-lock", ID: id})
+		if err := node.await(); err == nil {
+			t.Fatal("follower committed a record")
+		}
+		if address := node.leaderAddress(); address == "" {
+			t.Fatal("follower doesn't know the leader's address")
+		}
+	}
+
+	old := cluster
+	old.raft.Shutdown()
+	nodes = removeNode(nodes, old)
+	cluster = leader()
+	cluster.takeOver()
+	if l, ok := findLock("cluster-lock"); !ok || !l.holds(id) {
+		t.Fatal("lock not held by the new leader")
+	}
+	if h := l.holders[id]; h != nil {
+		t.Fatal("old leader's lock table not dropped")
+	}
+	if next := nextFence(); next <= fence {
+		t.Fatalf("fencing token %d after taking over, wanted more than %d", next, fence)
+	}
+}
+
+func removeNode(nodes []*clusterNode, node *clusterNode) []*clusterNode {
+	for i := range nodes {
+		if nodes[i] == node {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+// TestRing has keys another server owns moved there.
+func TestRing(t *testing.T) {
+	config.Ring = []string{"glock1:45625", "glock2:45625", "glock3:45625"}
+	config.Endpoint = "glock2:45625"
+	defer func() { config.Ring, config.Endpoint, ring = nil, "", nil }()
+	if err := loadRing(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConn(server, "")
+	reader := bufio.NewReader(client)
+	command := func(format string, a ...interface{}) []string {
+		fmt.Fprintf(client, format+"\r\n", a...)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(line)
+	}
+
+	if topology := command("TOPOLOGY"); strings.Join(topology, " ") != "TOPOLOGY glock1:45625 glock2:45625 glock3:45625" {
+		t.Fatal("unexpected topology: ", topology)
+	}
+	var own []string
+	var other string
+	for i := 0; len(own) < 2 || other == ""; i++ {
+		key := "ring-" + strconv.Itoa(i)
+		if owner, _ := ring.Get(key); owner == config.Endpoint {
+			own = append(own, key)
+		} else {
+			other = key
+		}
+	}
+	if locked := command("LOCK %s 1000", own[0]); locked[0] != "LOCKED" {
+		t.Fatal("unexpected response for own key: ", locked)
+	}
+	owner, _ := ring.Get(other)
+	if moved := command("LOCK %s 1000", other); strings.Join(moved, " ") != "MOVED "+owner {
+		t.Fatal("unexpected response for another server's key: ", moved)
+	}
+	if moved := command("MLOCK 1000 2 %s %s", own[1], other); strings.Join(moved, " ") != "MOVED "+owner {
+		t.Fatal("unexpected response for another server's key: ", moved)
+	}
+	for _, cmd := range []string{"UNLOCK %s 1", "RELEASE %s 1", "EXTEND %s 1 1000"} {
+		if moved := command(cmd, other); strings.Join(moved, " ") != "MOVED "+owner {
+			t.Fatal("unexpected response for another server's key: ", moved)
+		}
+	}
+}
+
+// TestReplicaUsers only lets the replica users replicate a server that authenticates clients.
+func TestReplicaUsers(t *testing.T) {
+	config.Authentication = map[string]string{"replica": "secret", "team": "secret"}
+	config.ReplicaUsers = []string{"replica"}
+	defer func() { config.Authentication, config.ReplicaUsers = nil, nil }()
+
+	replicate := func(user string) string {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleConn(server, user)
+		fmt.Fprintf(client, "REPLICATE\r\n")
+		line, err := bufio.NewReader(client).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+	if response := replicate("team"); response != "ERROR 403 unauthorized" {
+		t.Fatal("unexpected response for a user that isn't a replica: ", response)
+	}
+	if response := replicate("replica"); response != "REPLICATING" {
+		t.Fatal("unexpected response for a replica user: ", response)
+	}
+}
+
+// resetLocks empties the lock table, as if the server just started.
+func resetLocks() {
+	for i := range locks {
+		locks[i].mu.Lock()
+		locks[i].locks = make(map[string]*timeoutLock)
+		locks[i].mu.Unlock()
+	}
+}
+
+// every benchmark iteration uses a key nobody used before, like job ids do
+var benchKeys int64
+
+func nextBenchKey() string {
+	return "bench-" + strconv.FormatInt(atomic.AddInt64(&benchKeys, 1), 10)
+}
+
+func BenchmarkGetLock(b *testing.B) {
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			getLock(nextBenchKey())
+		}
+	})
+	sweep()
+}
+
+func BenchmarkLockUnlock(b *testing.B) {
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock := getLock(nextBenchKey())
+			id, _, err := lock.acquire(lockRequest{mode: exclusive}, lockOptions{wait: -1}, nil, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			lock.release(id)
+		}
+	})
+	sweep()
+}
+
+// BenchmarkConnections runs LOCK and UNLOCK over thousands of connections at once.
+func BenchmarkConnections(b *testing.B) {
+	b.SetParallelism(1000)
+	b.RunParallel(func(pb *testing.PB) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleConn(server, "")
+		reader := bufio.NewReader(client)
+		readLine := func() []string {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				b.Fatal(err)
+			}
+			return strings.Fields(line)
+		}
+
+		for pb.Next() {
+			key := nextBenchKey()
+			fmt.Fprintf(client, "LOCK %s 10000\r\n", key)
+			locked := readLine()
+			if locked[0] != "LOCKED" {
+				b.Fatal("unexpected response: ", locked)
+			}
+			fmt.Fprintf(client, "UNLOCK %s %s\r\n", key, locked[1])
+			if unlocked := readLine(); unlocked[0] != "UNLOCKED" {
+				b.Fatal("unexpected response: ", unlocked)
+			}
+		}
+	})
+	sweep()
+}
+
+// The expiry benchmarks schedule b.N lock timeouts that are all still pending
+// at the end, then cancel them, comparing the expiry heap with a time.AfterFunc
+// per lock.
+
+func BenchmarkExpiryScheduler(b *testing.B) {
+	b.ReportAllocs()
+	var s expiryScheduler
+	lock := newTimeoutLock("key")
+	expiries := make([]*expiry, b.N)
+	b.ResetTimer()
+	for i := range expiries {
+		expiries[i] = s.schedule("key", lock, int64(i), time.Hour+time.Duration(i))
+	}
+	for _, e := range expiries {
+		e.cancel()
+	}
+}
+
+func BenchmarkExpiryAfterFunc(b *testing.B) {
+	b.ReportAllocs()
+	lock := newTimeoutLock("key")
+	timers := make([]*time.Timer, b.N)
+	b.ResetTimer()
+	for i := range timers {
+		id := int64(i)
+		timers[i] = time.AfterFunc(time.Hour+time.Duration(i), func() { lock.release(id) })
+	}
+	for _, timer := range timers {
+		timer.Stop()
+	}
+}
+
+// BenchmarkExpiryExtend reschedules pending expiries, as EXTEND does.
+func BenchmarkExpiryExtend(b *testing.B) {
+	var s expiryScheduler
+	lock := newTimeoutLock("key")
+	expiries := make([]*expiry, 10000)
+	for i := range expiries {
+		expiries[i] = s.schedule("key", lock, int64(i), time.Hour+time.Duration(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		expiries[i%len(expiries)].reset(time.Hour + time.Duration(i))
+	}
+	b.StopTimer()
+	for _, e := range expiries {
+		e.cancel()
+	}
+}
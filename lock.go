@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockMode is how a lock is held.
+type lockMode int
+
+const (
+	exclusive lockMode = iota // LOCK: nobody else may hold the lock
+	semaphore                 // ACQUIRE: holders share a number of permits
+	shared                    // RLOCK: any number of readers may hold the lock together
+)
+
+// lockRequest is what a holder or waiter wants from a lock.
+type lockRequest struct {
+	mode    lockMode
+	permits int // semaphore only
+	max     int // semaphore only: how many permits there are in total
+	owner   string
+	user    string // who's asking, as authenticated
+}
+
+// timeoutLock is a lock that is handed to its waiters by priority, and in the
+// order they asked for it within the same priority. Waiting counts towards a
+// waiter's priority, one level per config.PriorityAging, so that low priority
+// waiters can't be starved.
+//
+// An exclusive lock has a single holder, while readers and semaphores can have
+// several, each with its own id and timeout. Since nobody may get ahead of the
+// front of the line, a writer waiting behind readers keeps new readers from
+// joining them.
+type timeoutLock struct {
+	key     string
+	mu      sync.Mutex
+	holders map[int64]*lockHolder // by id. Only allow an unlock if the correct id is passed
+	mode    lockMode              // of the current holders
+	used    int                   // permits taken by the current holders
+	max     int                   // permits in total, while held as a semaphore, see sameMax
+	waiters []*lockWaiter         // first in line first, see lockWaiter.rank
+
+	// dead is set once the sweeper removed the lock from its shard. Whoever
+	// still got it from there has to get a new one, see errLockRemoved.
+	dead bool
+}
+
+type lockHolder struct {
+	fence   int64 // see nextFence
+	permits int
+	owner   string
+	user    string  // only this user may unlock or extend the lock
+	holds   int     // times an exclusive lock was taken by its owner; it's unlocked when this drops to zero
+	expiry  *expiry // times the lock out
+}
+
+// waiters' ranks are measured from here, on the monotonic clock
+var rankEpoch = time.Now()
+
+type lockWaiter struct {
+	req   lockRequest
+	ready chan struct{} // closed once the lock is handed over
+	moved chan struct{} // signaled when the waiter's position changes, if it wants to know
+	id    int64
+	fence int64
+
+	// rank orders the line, lowest first. A waiter with priority p is treated as
+	// if it had started waiting p*config.PriorityAging earlier. Since everyone
+	// ages at the same rate, this never has to change while the waiter waits.
+	rank int64
+}
+
+func newTimeoutLock(key string) *timeoutLock {
+	return &timeoutLock{key: key, holders: make(map[int64]*lockHolder)}
+}
+
+// tryAcquire takes the lock only if that's possible without waiting behind
+// anyone, and fails with errLockHeld otherwise.
+func (l *timeoutLock) tryAcquire(req lockRequest) (id, fence int64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dead {
+		return 0, 0, errLockRemoved
+	}
+	if id, fence, ok := l.reenter(req); ok {
+		return id, fence, nil
+	}
+	if len(l.waiters) > 0 || !l.grantable(req) {
+		return 0, 0, errLockHeld
+	}
+	id, fence = l.grant(req)
+	return id, fence, nil
+}
+
+// acquire waits for the lock and returns the id it's held with, and its fencing
+// token. It gives up with
+// errWaitTimeout after opts.wait has passed, or with errCanceled once cancel is
+// closed. If queued isn't nil, it's called with the waiter's position in line
+// whenever that changes.
+func (l *timeoutLock) acquire(req lockRequest, opts lockOptions, cancel <-chan struct{}, queued func(position int)) (id, fence int64, err error) {
+	l.mu.Lock()
+	if l.dead {
+		l.mu.Unlock()
+		return 0, 0, errLockRemoved
+	}
+	if id, fence, ok := l.reenter(req); ok {
+		l.mu.Unlock()
+		return id, fence, nil
+	}
+	if !l.sameMax(req) {
+		l.mu.Unlock()
+		return 0, 0, errMaxMismatch
+	}
+	if len(l.waiters) == 0 && l.grantable(req) {
+		id, fence := l.grant(req)
+		l.mu.Unlock()
+		return id, fence, nil
+	}
+	// holders count towards the limit too
+	if config.LockLimit != 0 && int64(len(l.holders)+len(l.waiters)) >= config.LockLimit {
+		l.mu.Unlock()
+		return 0, 0, errAtCapacity
+	}
+	w := &lockWaiter{
+		req:   req,
+		ready: make(chan struct{}),
+		rank:  int64(time.Since(rankEpoch)) - int64(opts.priority)*config.PriorityAging*int64(time.Millisecond),
+	}
+	if queued != nil {
+		w.moved = make(chan struct{}, 1)
+	}
+	position := l.addWaiter(w)
+	// a high priority waiter may have gone straight to the front
+	l.grantWaiters()
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if opts.wait >= 0 {
+		timer := time.NewTimer(opts.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for err == nil {
+		if queued != nil && position > 0 {
+			queued(position)
+		}
+		select {
+		case <-w.ready:
+			return w.id, w.fence, nil
+		case <-w.moved:
+			l.mu.Lock()
+			position = l.position(w)
+			l.mu.Unlock()
+		case <-timeout:
+			err = errWaitTimeout
+		case <-cancel:
+			err = errCanceled
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// handed the lock just as we gave up
+		return w.id, w.fence, nil
+	default:
+	}
+	l.removeWaiter(w)
+	// whoever was stuck behind us may fit now
+	l.grantWaiters()
+	return 0, 0, err
+}
+
+// idle reports whether nobody holds or waits for the lock.
+func (l *timeoutLock) idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.holders) == 0 && len(l.waiters) == 0
+}
+
+// kill marks the lock dead if it's idle, and reports whether it did. The mutex of
+// the lock's shard must be held, so that nobody gets the lock in the meantime.
+func (l *timeoutLock) kill() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.holders) > 0 || len(l.waiters) > 0 {
+		return false
+	}
+	l.dead = true
+	return true
+}
+
+// holds reports whether id still holds the lock.
+func (l *timeoutLock) holds(id int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holders[id] != nil
+}
+
+// release gives up one hold of lock id, if it still holds the lock. Once the
+// last hold is given up the lock is unlocked and handed on to whoever is next in line.
+func (l *timeoutLock) release(id int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holders[id]
+	if !ok {
+		return false
+	}
+	l.releaseHold(id, h)
+	return true
+}
+
+// releaseBy is like release, on behalf of a client that authenticated as user
+// and expects the lock to be held in mode. It fails with errNotHeld if the lock
+// is held in another mode, and with errNotOwner if somebody else took the lock.
+func (l *timeoutLock) releaseBy(id int64, user string, mode lockMode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holders[id]
+	if !ok || l.mode != mode {
+		return errNotHeld
+	}
+	if h.user != user {
+		return errNotOwner
+	}
+	l.releaseHold(id, h)
+	return nil
+}
+
+// expire unlocks lock id however many times it's held, if e is still its expiry.
+func (l *timeoutLock) expire(id int64, e *expiry) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holders[id]
+	if !ok || h.expiry != e {
+		return false
+	}
+	l.unlock(id, h)
+	return true
+}
+
+// expireAfter schedules lock id to expire once timeout has passed, replacing
+// the expiry from an earlier hold of the same lock.
+func (l *timeoutLock) expireAfter(id int64, timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holders[id]
+	if !ok {
+		return
+	}
+	if h.expiry != nil {
+		h.expiry.cancel()
+	}
+	h.expiry = shardFor(l.key).expiries.schedule(l.key, l, id, timeout)
+	l.logHold(id, h)
+}
+
+// extend reschedules lock id's expiry to timeout from now, on behalf of user. It
+// fails with errNotHeld if id no longer holds the lock, including when it's
+// already expiring, and with errNotOwner if somebody else took the lock.
+func (l *timeoutLock) extend(id int64, user string, timeout time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holders[id]
+	if !ok || h.expiry == nil {
+		return errNotHeld
+	}
+	if h.user != user {
+		return errNotOwner
+	}
+	if !h.expiry.reset(timeout) {
+		return errNotHeld
+	}
+	l.logHold(id, h)
+	return nil
+}
+
+// grantable reports whether req could hold the lock alongside the current holders.
+// l.mu must be held.
+func (l *timeoutLock) grantable(req lockRequest) bool {
+	if len(l.holders) == 0 {
+		return req.mode != semaphore || req.permits <= req.max
+	}
+	if req.mode != l.mode || req.mode == exclusive {
+		return false
+	}
+	return req.mode != semaphore || l.used+req.permits <= l.max
+}
+
+// sameMax reports whether req agrees on the semaphore's max with the holders of
+// its permits and the semaphore requests waiting for them, since the first of
+// them decides how many permits there are. l.mu must be held.
+func (l *timeoutLock) sameMax(req lockRequest) bool {
+	if req.mode != semaphore {
+		return true
+	}
+	if l.mode == semaphore && len(l.holders) > 0 {
+		return req.max == l.max
+	}
+	for _, w := range l.waiters {
+		if w.req.mode == semaphore {
+			return req.max == w.req.max
+		}
+	}
+	return true
+}
+
+// grant makes req a holder and returns its id and fencing token. l.mu must be held.
+func (l *timeoutLock) grant(req lockRequest) (id, fence int64) {
+	permits := 1
+	if req.mode == semaphore {
+		permits = req.permits
+		if len(l.holders) == 0 {
+			l.max = req.max
+		}
+	}
+	id = l.newID()
+	fence = nextFence()
+	l.holders[id] = &lockHolder{fence: fence, permits: permits, owner: req.owner, user: req.user, holds: 1}
+	l.mode = req.mode
+	l.used += permits
+	return id, fence
+}
+
+// newID returns a random id that nobody holds the lock with. Since only the
+// holder knows it, nobody else can unlock the lock by guessing it. l.mu must be held.
+func (l *timeoutLock) newID() int64 {
+	for {
+		b, err := randByte(8)
+		if err != nil {
+			// there's no safe way to go on
+			panic(err)
+		}
+		id := int64(binary.BigEndian.Uint64(b) >> 1)
+		if _, taken := l.holders[id]; id != 0 && !taken {
+			return id
+		}
+	}
+}
+
+// reenter takes another hold of an exclusive lock that req's owner already
+// holds, and returns its id and fencing token. l.mu must be held.
+func (l *timeoutLock) reenter(req lockRequest) (id, fence int64, ok bool) {
+	if req.owner == "" || req.mode != exclusive || l.mode != exclusive {
+		return 0, 0, false
+	}
+	for id, h := range l.holders {
+		if h.owner == req.owner && h.user == req.user {
+			h.holds++
+			return id, h.fence, true
+		}
+	}
+	return 0, 0, false
+}
+
+// releaseHold gives up one of h's holds, and unlocks it if that was the last. l.mu must be held.
+func (l *timeoutLock) releaseHold(id int64, h *lockHolder) {
+	h.holds--
+	if h.holds == 0 {
+		l.unlock(id, h)
+	} else {
+		l.logHold(id, h)
+	}
+}
+
+// unlock removes holder h, whose id is id, and hands the lock on. l.mu must be held.
+func (l *timeoutLock) unlock(id int64, h *lockHolder) {
+	if h.expiry != nil {
+		h.expiry.cancel()
+		l.logRelease(id)
+	}
+	delete(l.holders, id)
+	l.used -= h.permits
+	l.grantWaiters()
+}
+
+// grantWaiters hands the lock to waiters from the front of the line for as long
+// as they fit next to its holders. l.mu must be held.
+func (l *timeoutLock) grantWaiters() {
+	for len(l.waiters) > 0 && l.grantable(l.waiters[0].req) {
+		w := l.waiters[0]
+		l.removeWaiter(w)
+		w.id, w.fence = l.grant(w.req)
+		close(w.ready)
+	}
+}
+
+// position returns w's 1-based place in line, or 0 if it isn't waiting anymore.
+// l.mu must be held.
+func (l *timeoutLock) position(w *lockWaiter) int {
+	for i, waiter := range l.waiters {
+		if waiter == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// addWaiter puts w in line behind everyone with the same or a lower rank, and
+// returns its position. l.mu must be held.
+func (l *timeoutLock) addWaiter(w *lockWaiter) int {
+	i := sort.Search(len(l.waiters), func(i int) bool {
+		return l.waiters[i].rank > w.rank
+	})
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+	l.notifyMoved(i + 1)
+	return i + 1
+}
+
+// removeWaiter takes w out of line and tells everyone behind it that they moved up.
+// l.mu must be held.
+func (l *timeoutLock) removeWaiter(w *lockWaiter) {
+	i := l.position(w) - 1
+	if i < 0 {
+		return
+	}
+	copy(l.waiters[i:], l.waiters[i+1:])
+	l.waiters[len(l.waiters)-1] = nil
+	l.waiters = l.waiters[:len(l.waiters)-1]
+	l.notifyMoved(i)
+}
+
+// notifyMoved tells the waiters from index i on that their position changed.
+// l.mu must be held.
+func (l *timeoutLock) notifyMoved(i int) {
+	for _, w := range l.waiters[i:] {
+		if w.moved != nil {
+			select {
+			case w.moved <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
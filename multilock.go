@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// parseMultiLock parses the arguments of an MLOCK:
+//
+//	MLOCK <timeout> <count> <key>... [options]
+func parseMultiLock(split []string) (timeout int, keys []string, opts lockOptions, err error) {
+	if len(split) < 4 {
+		return 0, nil, opts, errors.New("missing multi lock arguments")
+	}
+	if timeout, err = strconv.Atoi(split[1]); err != nil {
+		return 0, nil, opts, fmt.Errorf("bad multi lock timeout %q", split[1])
+	}
+	count, err := strconv.Atoi(split[2])
+	if err != nil || count <= 0 || count > len(split)-3 {
+		return 0, nil, opts, fmt.Errorf("bad multi lock key count %q", split[2])
+	}
+	keys = split[3 : 3+count]
+	seen := make(map[string]bool, count)
+	for _, key := range keys {
+		if seen[key] {
+			return 0, nil, opts, fmt.Errorf("duplicate multi lock key %q", key)
+		}
+		seen[key] = true
+	}
+	opts, err = parseLockOptions(split[3+count:])
+	return timeout, keys, opts, err
+}
+
+// acquireMulti takes the locks on all of keys for user, or on none of them, and
+// returns their ids and fencing tokens in the order of keys. The locks are taken
+// in sorted order, so two MLOCKs can't deadlock each other, and any already taken
+// are released again if one can't be. opts.wait bounds the wait for all of them
+// together.
+func acquireMulti(keys []string, user string, opts lockOptions, cancel <-chan struct{}) (ids, fences []int64, err error) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+
+	var deadline time.Time
+	if opts.wait >= 0 {
+		deadline = time.Now().Add(opts.wait)
+	}
+
+	ids = make([]int64, len(keys))
+	fences = make([]int64, len(keys))
+	for n, i := range order {
+		if !deadline.IsZero() {
+			if opts.wait = time.Until(deadline); opts.wait < 0 {
+				opts.wait = 0
+			}
+		}
+		for err = errLockRemoved; err == errLockRemoved; {
+			ids[i], fences[i], err = getLock(keys[i]).acquire(lockRequest{mode: exclusive, user: user}, opts, cancel, nil)
+		}
+		if err != nil {
+			for _, j := range order[:n] {
+				getLock(keys[j]).release(ids[j])
+			}
+			return nil, nil, err
+		}
+	}
+	return ids, fences, nil
+}
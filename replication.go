@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// A glock server can stream its locks to replicas, so that one of them can take
+// over with the same holders, ids and fencing tokens once the server is gone.
+// A replica connects to its primary, config.ReplicaOf, and sends REPLICATE. The
+// primary responds with REPLICATING, followed by the records of the write-ahead
+// log as JSON lines: first one for every lock held at the time, then a synced
+// record, then every change as it happens, each with a sequence number that the
+// replica acknowledges with ACK <seq>. A LOCK or EXTEND isn't answered before
+// every replica acknowledged it, so whatever a client was told it holds, the
+// replicas know about. Since the replicas see every lock and hold up every LOCK,
+// only the users in config.ReplicaUsers may replicate a server that authenticates
+// its clients.
+//
+// A replica doesn't accept connections of its own. Once it hasn't heard from its
+// primary for config.FailoverTimeout, it holds the locks it was sent and serves
+// clients in its place. The locks time out config.ClockDrift later than the
+// primary would have timed them out, in case the replica's clock is ahead.
+// Clients name a primary and its replicas as one endpoint, see the client's
+// NewClient. Nothing stops a primary that is merely cut off from its replica, so
+// they mustn't be partitioned for longer than the timeout, and a primary that
+// comes back after a failover has to come back as a replica.
+//
+// Only one replica may take over, or two of them would hand out the same locks.
+// The replicas of a primary are ranked: each lists the ones ranked above it in
+// config.Successors, in order, and instead of taking over it replicates the
+// first of them that is still there, which took over in turn. Only the replica
+// that has nobody left to follow takes over.
+
+const (
+	walSynced    = "synced"    // the replica has been sent every held lock
+	walHeartbeat = "heartbeat" // the primary is still there, even if nothing changes
+)
+
+const (
+	replicationHeartbeat = time.Second
+	replicationTimeout   = 5 * time.Second // a replica that doesn't acknowledge a change within this is dropped
+	replicationBuffer    = 4096            // changes queued for a replica before it's considered too slow
+	replicaRetry         = 200 * time.Millisecond
+)
+
+var replication struct {
+	mu       sync.Mutex
+	acked    *sync.Cond // broadcast whenever a replica acknowledges something or goes away
+	seq      int64      // of the last change sent
+	replicas map[*replica]bool
+}
+
+func init() {
+	replication.acked = sync.NewCond(&replication.mu)
+	replication.replicas = make(map[*replica]bool)
+}
+
+// replica is a connection from a replica, as seen by the primary.
+type replica struct {
+	conn    net.Conn
+	records chan walRecord
+	acked   int64         // the last seq the replica acknowledged
+	gone    chan struct{} // closed once the replica is dropped
+}
+
+// publish sends r to the replicas, if there are any.
+func publish(r walRecord) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if len(replication.replicas) == 0 {
+		return
+	}
+	replication.seq++
+	r.Seq = replication.seq
+	for rep := range replication.replicas {
+		select {
+		case rep.records <- r:
+		default:
+			log15.Error("replica too far behind, dropping it", "replica", rep.conn.RemoteAddr())
+			dropReplica(rep)
+		}
+	}
+}
+
+// awaitReplicas waits until every replica acknowledged the changes published so
+// far, dropping the ones that take longer than replicationTimeout.
+func awaitReplicas() {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	seq := replication.seq
+	deadline := time.Now().Add(replicationTimeout)
+	var timer *time.Timer
+	for {
+		var lagging []*replica
+		for rep := range replication.replicas {
+			if rep.acked < seq {
+				lagging = append(lagging, rep)
+			}
+		}
+		if len(lagging) == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			for _, rep := range lagging {
+				log15.Error("replica didn't acknowledge in time, dropping it", "replica", rep.conn.RemoteAddr(), "seq", seq)
+				dropReplica(rep)
+			}
+			break
+		}
+		if timer == nil {
+			timer = time.AfterFunc(replicationTimeout, func() {
+				replication.mu.Lock()
+				replication.acked.Broadcast()
+				replication.mu.Unlock()
+			})
+			defer timer.Stop()
+		}
+		replication.acked.Wait()
+	}
+}
+
+// dropReplica stops sending to rep and closes its connection. replication.mu must be held.
+func dropReplica(rep *replica) {
+	if !replication.replicas[rep] {
+		return
+	}
+	delete(replication.replicas, rep)
+	close(rep.gone)
+	rep.conn.Close()
+	replication.acked.Broadcast()
+}
+
+// replicaCount returns the number of connected replicas.
+func replicaCount() int {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	return len(replication.replicas)
+}
+
+// replicaUser reports whether user may replicate the server.
+func replicaUser(user string) bool {
+	if len(config.Authentication) == 0 {
+		// anyone may do anything
+		return true
+	}
+	for _, replica := range config.ReplicaUsers {
+		if user == replica {
+			return true
+		}
+	}
+	return false
+}
+
+// serveReplica streams the locks to a replica that sent REPLICATE on conn, and
+// reads its acknowledgements from commands until the connection goes away.
+func serveReplica(conn net.Conn, commands *commandReader) {
+	rep := &replica{conn: conn, records: make(chan walRecord, replicationBuffer), gone: make(chan struct{})}
+	replication.mu.Lock()
+	// everything up to here is in the held locks that are sent first
+	rep.acked = replication.seq
+	replication.replicas[rep] = true
+	replication.mu.Unlock()
+	log15.Info("replica connected", "replica", conn.RemoteAddr())
+
+	go sendReplication(rep)
+	for {
+		split, ok := commands.next()
+		if !ok {
+			break
+		}
+		if split[0] != "ACK" || len(split) != 2 {
+			log15.Error("unexpected command from replica", "replica", conn.RemoteAddr(), "cmd", split)
+			break
+		}
+		seq, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			log15.Error("bad acknowledgement from replica", "replica", conn.RemoteAddr(), "cmd", split)
+			break
+		}
+		replication.mu.Lock()
+		if seq > rep.acked {
+			rep.acked = seq
+			replication.acked.Broadcast()
+		}
+		replication.mu.Unlock()
+	}
+
+	replication.mu.Lock()
+	dropReplica(rep)
+	replication.mu.Unlock()
+	log15.Info("replica disconnected", "replica", conn.RemoteAddr())
+}
+
+// sendReplication writes the held locks to rep, and then the changes published
+// for it, until it's dropped.
+func sendReplication(rep *replica) {
+	w := bufio.NewWriter(rep.conn)
+	encoder := json.NewEncoder(w)
+	flush := func() error {
+		rep.conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return w.Flush()
+	}
+
+	w.WriteString("REPLICATING\r\n")
+	for _, r := range heldLocks() {
+		encoder.Encode(r)
+	}
+	encoder.Encode(walRecord{Op: walSynced})
+	err := flush()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for err == nil {
+		select {
+		case r := <-rep.records:
+			encoder.Encode(r)
+			// send whatever else is queued along with it
+			for n := len(rep.records); n > 0; n-- {
+				encoder.Encode(<-rep.records)
+			}
+		case <-heartbeat.C:
+			encoder.Encode(walRecord{Op: walHeartbeat})
+		case <-rep.gone:
+			return
+		}
+		err = flush()
+	}
+
+	log15.Error("error sending to replica", "replica", rep.conn.RemoteAddr(), "err", err)
+	replication.mu.Lock()
+	dropReplica(rep)
+	replication.mu.Unlock()
+}
+
+// replicaState is what a replica knows about its primary's locks.
+type replicaState struct {
+	mu          sync.Mutex
+	held        *heldSet // as of the last time the replica was synced; nil before that
+	lastContact time.Time
+}
+
+// followPrimary replicates config.ReplicaOf until it's been gone for
+// config.FailoverTimeout, and then each of config.Successors in turn, since they
+// take over before this replica does. It returns the locks held by the last of
+// them once that's gone too.
+func followPrimary() *heldSet {
+	timeout := time.Duration(config.FailoverTimeout) * time.Millisecond
+	primaries := append([]string{config.ReplicaOf}, config.Successors...)
+	state := &replicaState{lastContact: time.Now()}
+	for i := 0; ; {
+		err := state.replicateFrom(primaries[i], timeout)
+		state.mu.Lock()
+		held, lastContact := state.held, state.lastContact
+		state.mu.Unlock()
+		if time.Since(lastContact) < timeout {
+			log15.Error("error replicating", "primary", primaries[i], "err", err)
+		} else if i+1 < len(primaries) {
+			log15.Warn("primary gone, following its successor", "primary", primaries[i], "successor", primaries[i+1], "err", err)
+			i++
+			// give the successor as long to take over as its primary had to come back
+			state.mu.Lock()
+			state.lastContact = time.Now()
+			state.mu.Unlock()
+			continue
+		} else if held == nil {
+			// there's nothing to take over with
+			log15.Error("error replicating, never synced with primary", "primary", primaries[i], "err", err)
+		} else {
+			log15.Warn("primary gone, taking over", "primary", primaries[i], "err", err)
+			return held
+		}
+		time.Sleep(replicaRetry)
+	}
+}
+
+// replicateFrom connects to the primary at address and follows it until the
+// connection fails, or it doesn't hear from it for timeout.
+func (s *replicaState) replicateFrom(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if config.ReplicaUsername != "" {
+		if err := authenticate(conn, reader, config.ReplicaUsername, config.ReplicaPassword); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte("REPLICATE\r\n")); err != nil {
+		return err
+	}
+	return s.follow(conn, reader, timeout)
+}
+
+// follow reads what the primary sends after a REPLICATE, acknowledging every change.
+func (s *replicaState) follow(conn net.Conn, reader *bufio.Reader, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != "REPLICATING" {
+		return errors.New(line)
+	}
+
+	// the held locks are collected apart until they're all there
+	syncing := newHeldSet()
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var r walRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.lastContact = time.Now()
+		switch r.Op {
+		case walSynced:
+			s.held = syncing
+		case walHeartbeat:
+		default:
+			syncing.apply(r)
+		}
+		s.mu.Unlock()
+
+		if r.Seq != 0 {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := fmt.Fprintf(conn, "ACK %d\r\n", r.Seq); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authenticate logs in to another glock server on conn, the way clients do.
+func authenticate(conn net.Conn, reader *bufio.Reader, username, password string) error {
+	if _, err := fmt.Fprintf(conn, "AUTH %s\r\n", username); err != nil {
+		return err
+	}
+	challenge, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	authKey, err := base64.StdEncoding.DecodeString(strings.TrimRight(challenge, "\r\n"))
+	if err != nil {
+		return errors.New(strings.TrimRight(challenge, "\r\n"))
+	}
+
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte(password))
+	if _, err := fmt.Fprintf(conn, "AUTH %s %s\r\n", username, base64.StdEncoding.EncodeToString(mac.Sum(nil))); err != nil {
+		return err
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if response = strings.TrimRight(response, "\r\n"); response != "AUTHORIZED" {
+		return errors.New(response)
+	}
+	return nil
+}
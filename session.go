@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	aliveResponse = []byte("ALIVE\r\n")
+	endedResponse = []byte("ENDED\r\n")
+)
+
+// session ties locks to a client being alive. When the session ends, because
+// its heartbeats stopped or the connection it belongs to closed, its locks are
+// released right away instead of when they time out.
+type session struct {
+	id   string
+	ttl  time.Duration // zero for sessions that belong to a connection
+	user string        // who started it; only this user may use or end it
+
+	mu    sync.Mutex
+	timer *time.Timer
+	held  []sessionLock
+	ended bool
+}
+
+type sessionLock struct {
+	key  string
+	lock *timeoutLock
+	id   int64
+}
+
+var sessionsLock sync.Mutex
+var sessions = map[string]*session{}
+
+// newSession starts a session for user that ends unless it's kept alive within every ttl.
+func newSession(ttl time.Duration, user string) (*session, error) {
+	b, err := randByte(12)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{id: hex.EncodeToString(b), ttl: ttl, user: user}
+
+	s.mu.Lock()
+	s.timer = time.AfterFunc(ttl, func() {
+		log15.Debug("session timed out", "session", s.id, "ttl", ttl)
+		s.end()
+	})
+	s.mu.Unlock()
+
+	sessionsLock.Lock()
+	sessions[s.id] = s
+	sessionsLock.Unlock()
+	return s, nil
+}
+
+func getSession(id string) (*session, bool) {
+	sessionsLock.Lock()
+	s, ok := sessions[id]
+	sessionsLock.Unlock()
+	return s, ok
+}
+
+// keepAlive gives the session another ttl to live. It reports false if it already ended.
+func (s *session) keepAlive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended || !s.timer.Stop() {
+		return false
+	}
+	s.timer.Reset(s.ttl)
+	return true
+}
+
+// add ties lock id to the session. It reports false if the session already
+// ended, in which case the caller has to release the lock itself.
+func (s *session) add(key string, lock *timeoutLock, id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return false
+	}
+
+	// forget locks that were already unlocked or timed out
+	held := s.held[:0]
+	for _, h := range s.held {
+		if h.lock.holds(h.id) {
+			held = append(held, h)
+		}
+	}
+	s.held = append(held, sessionLock{key: key, lock: lock, id: id})
+	return true
+}
+
+// end releases all of the session's locks that are still held.
+func (s *session) end() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	held := s.held
+	s.held = nil
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	if s.id != "" {
+		sessionsLock.Lock()
+		delete(sessions, s.id)
+		sessionsLock.Unlock()
+	}
+
+	for _, h := range held {
+		if h.lock.release(h.id) {
+			log15.Debug("released session lock", "session", s.id, "key", h.key, "id", h.id)
+		}
+	}
+}
+
+// handleSessionCommand handles the commands that manage sessions, on behalf of
+// a client that authenticated as user:
+//
+//	SESSION <ttl>
+//	KEEPALIVE <session>
+//	ENDSESSION <session>
+func handleSessionCommand(conn net.Conn, split []string, user string) {
+	if len(split) < 2 {
+		conn.Write(errBadFormat)
+		log15.Error("bad command format", "cmd", split)
+		return
+	}
+
+	switch split[0] {
+	case "SESSION":
+		ttl, err := strconv.Atoi(split[1])
+		if err != nil || ttl <= 0 {
+			conn.Write(errBadFormat)
+			log15.Error("bad command format", "cmd", split)
+			return
+		}
+		s, err := newSession(time.Duration(ttl)*time.Millisecond, user)
+		if err != nil {
+			conn.Write(errInternal)
+			log15.Error("error creating session", "cmd", split, "err", err)
+			return
+		}
+		fmt.Fprintf(conn, "SESSION %s\r\n", s.id)
+		log15.Debug("session started", "cmd", split, "session", s.id)
+
+	case "KEEPALIVE":
+		s, ok := getSession(split[1])
+		if ok && s.user != user {
+			conn.Write(errNotLockOwner)
+			log15.Info("keepalive by another user rejected", "cmd", split, "user", user)
+			return
+		}
+		if !ok || !s.keepAlive() {
+			conn.Write(errSessionNotFound)
+			log15.Debug("session not found", "cmd", split)
+			return
+		}
+		conn.Write(aliveResponse)
+
+	case "ENDSESSION":
+		s, ok := getSession(split[1])
+		if !ok {
+			conn.Write(errSessionNotFound)
+			log15.Debug("session not found", "cmd", split)
+			return
+		}
+		if s.user != user {
+			conn.Write(errNotLockOwner)
+			log15.Info("end of session by another user rejected", "cmd", split, "user", user)
+			return
+		}
+		s.end()
+		conn.Write(endedResponse)
+		log15.Debug("session ended", "cmd", split, "session", s.id)
+	}
+}
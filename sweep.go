@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// sweepLocks removes the locks nobody holds or waits for every interval, so
+// that keys that are never used again don't take up memory forever.
+func sweepLocks(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, live := sweep()
+		log15.Info("swept locks", "removed", removed, "live", live)
+	}
+}
+
+// sweep removes the idle locks, and returns how many it removed and how many are left.
+func sweep() (removed, live int) {
+	for i := range locks {
+		removed += locks[i].sweep()
+	}
+	return removed, liveLocks()
+}
+
+// sweep removes the shard's idle locks and returns how many it removed.
+func (s *lockShard) sweep() (removed int) {
+	// find the candidates without holding up getLock for long
+	var idle []string
+	s.mu.RLock()
+	for key, lock := range s.locks {
+		if lock.idle() {
+			idle = append(idle, key)
+		}
+	}
+	s.mu.RUnlock()
+	if len(idle) == 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range idle {
+		// somebody may have started using it since
+		if lock, ok := s.locks[key]; ok && lock.kill() {
+			delete(s.locks, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// liveLocks returns the number of keys the server keeps a lock for.
+func liveLocks() (live int) {
+	for i := range locks {
+		locks[i].mu.RLock()
+		live += len(locks[i].locks)
+		locks[i].mu.RUnlock()
+	}
+	return live
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// The locks are spread over shards by the hash of their key, each with a mutex
+// of its own, so that connections working on different keys don't contend.
+const lockShards = 256
+
+type lockShard struct {
+	mu       sync.RWMutex
+	locks    map[string]*timeoutLock
+	expiries expiryScheduler
+}
+
+var locks [lockShards]lockShard
+
+func init() {
+	for i := range locks {
+		locks[i].locks = make(map[string]*timeoutLock)
+	}
+}
+
+func shardFor(key string) *lockShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &locks[h.Sum32()%lockShards]
+}
+
+// getLock returns the lock for key, creating it if it doesn't exist yet.
+func getLock(key string) *timeoutLock {
+	shard := shardFor(key)
+	shard.mu.RLock()
+	lock, ok := shard.locks[key]
+	shard.mu.RUnlock()
+	if !ok {
+		// lock doesn't exist; create it
+		shard.mu.Lock()
+		lock, ok = shard.locks[key]
+		if !ok {
+			lock = newTimeoutLock(key)
+			shard.locks[key] = lock
+		}
+		shard.mu.Unlock()
+	}
+	return lock
+}
+
+// findLock returns the lock for key, if there is one.
+func findLock(key string) (*timeoutLock, bool) {
+	shard := shardFor(key)
+	shard.mu.RLock()
+	lock, ok := shard.locks[key]
+	shard.mu.RUnlock()
+	return lock, ok
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"stathat.com/c/consistent"
+)
+
+// Servers that share keys between them can know the hash ring their clients
+// spread the keys over: config.Ring lists the endpoints of all of them, the way
+// clients reach them, and config.Endpoint is this server's. A server that knows
+// the ring answers a LOCK for a key another server owns with MOVED <endpoint>,
+// and TOPOLOGY with the ring's endpoints, which clients build their own ring
+// from, so that they all agree on where every key goes. The ring is hashed the
+// same way the client does it.
+
+// ring holds config.Ring, or is nil if the server doesn't know the ring.
+var ring *consistent.Consistent
+
+// loadRing sets up the ring from config.Ring.
+func loadRing() error {
+	if len(config.Ring) == 0 {
+		return nil
+	}
+	found := false
+	r := consistent.New()
+	for _, endpoint := range config.Ring {
+		if strings.ContainsAny(endpoint, " \r\n") {
+			return fmt.Errorf("bad ring endpoint %q", endpoint)
+		}
+		if endpoint == config.Endpoint {
+			found = true
+		}
+		r.Add(endpoint)
+	}
+	if !found {
+		return fmt.Errorf("endpoint %q isn't in the ring", config.Endpoint)
+	}
+	ring = r
+	return nil
+}
+
+// moved responds with MOVED if another server owns key, and reports whether it did.
+func moved(conn net.Conn, key string) bool {
+	if ring == nil {
+		return false
+	}
+	owner, err := ring.Get(key)
+	if err != nil || owner == config.Endpoint {
+		return false
+	}
+	fmt.Fprintf(conn, "MOVED %s\r\n", owner)
+	return true
+}
+
+// topology returns the TOPOLOGY response.
+func topology() string {
+	if ring == nil {
+		return "TOPOLOGY\r\n"
+	}
+	return "TOPOLOGY " + strings.Join(config.Ring, " ") + "\r\n"
+}
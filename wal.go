@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// With config.DataDir set, held locks survive a restart. Every change to a
+// holder is appended to a write-ahead log and synced to disk before the client
+// hears about it. Every config.SnapshotInterval the held locks are written to a
+// snapshot and the log starts over in a new file, so that it doesn't grow
+// forever. On startup the snapshot and the logs after it are replayed, and the
+// locks that haven't timed out yet are held again, expiring when they would
+// have, by the wall clock.
+//
+// Waiters aren't kept, since they lose their connections anyway, and neither
+// are sessions: a lock that belonged to a session only times out after a restart.
+
+const (
+	walHold    = "hold"    // sets everything about a holder
+	walRelease = "release" // the holder is gone
+)
+
+// walRecord is a line of the log. Replaying the records in order leaves every
+// lock with its latest holders, and replaying one again changes nothing.
+type walRecord struct {
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	ID      int64     `json:"id"`
+	Fence   int64     `json:"fence,omitempty"`
+	Mode    lockMode  `json:"mode,omitempty"`
+	Permits int       `json:"permits,omitempty"`
+	Max     int       `json:"max,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Holds   int       `json:"holds,omitempty"`
+	Expires time.Time `json:"expires"`
+	Seq     int64     `json:"seq,omitempty"` // only when replicating, see publish
+}
+
+type snapshot struct {
+	WAL   int64       `json:"wal"` // the first log that isn't in the snapshot yet
+	Holds []walRecord `json:"holds"`
+}
+
+var wal struct {
+	mu   sync.Mutex
+	seq  int64 // of the log being written
+	file *os.File
+}
+
+func walPath(seq int64) string {
+	return filepath.Join(config.DataDir, "wal."+strconv.FormatInt(seq, 10))
+}
+
+func snapshotPath() string {
+	return filepath.Join(config.DataDir, "snapshot")
+}
+
+// logHold appends holder h of lock id to the log. l.mu must be held, which keeps
+// a lock's records in order.
+func (l *timeoutLock) logHold(id int64, h *lockHolder) {
+	record(l.holdRecord(id, h))
+}
+
+// holdRecord returns the record that restores holder h of lock id. l.mu must be held.
+func (l *timeoutLock) holdRecord(id int64, h *lockHolder) walRecord {
+	return walRecord{
+		Op:      walHold,
+		Key:     l.key,
+		ID:      id,
+		Fence:   h.fence,
+		Mode:    l.mode,
+		Permits: h.permits,
+		Max:     l.max,
+		Owner:   h.owner,
+		User:    h.user,
+		Holds:   h.holds,
+		Expires: h.expiry.at,
+	}
+}
+
+// logRelease appends the end of lock id's hold to the log. l.mu must be held.
+func (l *timeoutLock) logRelease(id int64) {
+	record(walRecord{Op: walRelease, Key: l.key, ID: id})
+}
+
+// record appends r to the log and sends it to the replicas, or proposes it to
+// the cluster in cluster mode.
+func record(r walRecord) {
+	if cluster != nil {
+		cluster.propose(r)
+		return
+	}
+	if config.DataDir != "" {
+		appendWAL(r)
+	}
+	publish(r)
+}
+
+func appendWAL(r walRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log15.Error("error encoding log record", "key", r.Key, "err", err)
+		return
+	}
+	b = append(b, '\n')
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if _, err = wal.file.Write(b); err == nil {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		// the lock still works, but it won't survive a restart
+		log15.Error("error writing log record", "file", wal.file.Name(), "key", r.Key, "id", r.ID, "err", err)
+	}
+}
+
+// restoreLocks holds the locks from config.DataDir again, and starts logging.
+func restoreLocks() error {
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return err
+	}
+	snap, err := readSnapshot()
+	if err != nil {
+		return err
+	}
+	seqs, err := walSeqs()
+	if err != nil {
+		return err
+	}
+
+	held := newHeldSet()
+	for _, r := range snap.Holds {
+		held.apply(r)
+	}
+	for _, seq := range seqs {
+		if seq < snap.WAL {
+			continue
+		}
+		if err := replayWAL(seq, held.apply); err != nil {
+			return err
+		}
+	}
+	// restored locks may time out right away, which has to be logged
+	if err := startLogging(); err != nil {
+		return err
+	}
+	restored := held.restore(0)
+	log15.Info("restored locks", "dir", config.DataDir, "locks", restored, "fence", held.maxFence)
+
+	// get rid of the logs that were just replayed
+	return takeSnapshot()
+}
+
+// startLogging starts a new log in config.DataDir after the ones already there.
+func startLogging() error {
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return err
+	}
+	seqs, err := walSeqs()
+	if err != nil {
+		return err
+	}
+	if len(seqs) > 0 {
+		wal.seq = seqs[len(seqs)-1]
+	}
+	_, err = rotateWAL()
+	return err
+}
+
+// heldSet is what replaying records leaves behind: the holders of every key, by id.
+type heldSet struct {
+	holders  map[string]map[int64]walRecord
+	maxFence int64 // the largest fencing token in any of the records
+}
+
+func newHeldSet() *heldSet {
+	return &heldSet{holders: make(map[string]map[int64]walRecord)}
+}
+
+func (s *heldSet) apply(r walRecord) {
+	if r.Fence > s.maxFence {
+		s.maxFence = r.Fence
+	}
+	switch r.Op {
+	case walHold:
+		if s.holders[r.Key] == nil {
+			s.holders[r.Key] = make(map[int64]walRecord)
+		}
+		s.holders[r.Key][r.ID] = r
+	case walRelease:
+		delete(s.holders[r.Key], r.ID)
+		if len(s.holders[r.Key]) == 0 {
+			delete(s.holders, r.Key)
+		}
+	}
+}
+
+// records returns a hold record for every holder.
+func (s *heldSet) records() []walRecord {
+	var records []walRecord
+	for _, holders := range s.holders {
+		for _, r := range holders {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// restore holds the locks that haven't timed out yet again, and returns how many
+// it restored. The locks time out drift later than they were meant to, for when
+// they were taken on another server, whose clock may be behind this one's.
+// Fencing tokens go on from the largest one ever handed out, even if its lock is gone.
+func (s *heldSet) restore(drift time.Duration) (restored int) {
+	raiseFence(s.maxFence)
+	for _, holders := range s.holders {
+		for _, r := range holders {
+			r.Expires = r.Expires.Add(drift)
+			if time.Now().Before(r.Expires) {
+				restoreHolder(r)
+				restored++
+			}
+		}
+	}
+	return restored
+}
+
+// restoreHolder makes r's holder hold its lock again, until r.Expires.
+func restoreHolder(r walRecord) {
+	lock := getLock(r.Key)
+	lock.mu.Lock()
+	for lock.dead {
+		// the sweeper removed it in the meantime
+		lock.mu.Unlock()
+		lock = getLock(r.Key)
+		lock.mu.Lock()
+	}
+	defer lock.mu.Unlock()
+	h := &lockHolder{fence: r.Fence, permits: r.Permits, owner: r.Owner, user: r.User, holds: r.Holds}
+	h.expiry = shardFor(r.Key).expiries.schedule(r.Key, lock, r.ID, time.Until(r.Expires))
+	lock.holders[r.ID] = h
+	lock.mode = r.Mode
+	lock.used += r.Permits
+	lock.max = r.Max
+}
+
+func readSnapshot() (snapshot, error) {
+	var snap snapshot
+	b, err := ioutil.ReadFile(snapshotPath())
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	return snap, json.Unmarshal(b, &snap)
+}
+
+// walSeqs returns the numbers of the logs in config.DataDir, in order.
+func walSeqs() ([]int64, error) {
+	files, err := ioutil.ReadDir(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int64
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "wal.") {
+			continue
+		}
+		if seq, err := strconv.ParseInt(strings.TrimPrefix(f.Name(), "wal."), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// replayWAL passes the records of log seq to apply. A record the server was
+// still writing when it went down is left out; nobody was told about it.
+func replayWAL(seq int64, apply func(walRecord)) error {
+	f, err := os.Open(walPath(seq))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log15.Warn("skipping incomplete log record", "file", f.Name())
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var r walRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		apply(r)
+	}
+}
+
+// snapshotLocks takes a snapshot every interval.
+func snapshotLocks(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := takeSnapshot(); err != nil {
+			log15.Error("error taking snapshot", "dir", config.DataDir, "err", err)
+		}
+	}
+}
+
+// takeSnapshot switches to a new log, then writes the held locks to the
+// snapshot and removes the logs before the new one. A change made while the
+// locks are collected may be in both the snapshot and the new log, which is
+// fine, since replaying it again changes nothing.
+func takeSnapshot() error {
+	seq, err := rotateWAL()
+	if err != nil {
+		return err
+	}
+	snap := snapshot{WAL: seq, Holds: heldLocks()}
+	if err := writeSnapshot(snap); err != nil {
+		return err
+	}
+	seqs, err := walSeqs()
+	if err != nil {
+		return err
+	}
+	for _, old := range seqs {
+		if old < seq {
+			os.Remove(walPath(old))
+		}
+	}
+	log15.Debug("took snapshot", "locks", len(snap.Holds), "wal", seq)
+	return nil
+}
+
+// rotateWAL starts a new log, and returns its number.
+func rotateWAL() (int64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	f, err := os.OpenFile(walPath(wal.seq+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if wal.file != nil {
+		wal.file.Close()
+	}
+	wal.file = f
+	wal.seq++
+	return wal.seq, nil
+}
+
+// heldLocks returns a hold record for every lock holder that has been logged.
+func heldLocks() []walRecord {
+	var holds []walRecord
+	for i := range locks {
+		shard := &locks[i]
+		shard.mu.RLock()
+		for _, lock := range shard.locks {
+			lock.mu.Lock()
+			for id, h := range lock.holders {
+				if h.expiry == nil {
+					// not logged yet
+					continue
+				}
+				holds = append(holds, lock.holdRecord(id, h))
+			}
+			lock.mu.Unlock()
+		}
+		shard.mu.RUnlock()
+	}
+	return holds
+}
+
+// writeSnapshot durably replaces the snapshot, like storeFence.
+func writeSnapshot(snap snapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := snapshotPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, snapshotPath())
+}